@@ -2,31 +2,40 @@ package main
 
 import (
     "oauth" // from https://github.com/demoforwork/public/tree/master/oauth
+    "oauth/oauthcmd"
     
     "bytes"
+    "crypto/sha256"
     "encoding/base64"
+    "encoding/csv"
+    "encoding/hex"
     "encoding/json"
     "errors"
     "fmt"
     "html/template" // same interface as text/template package but automatically secures HTML output against certain attack
     "io/ioutil"
     "log"
+    "net/http"
     "os"
+    "path/filepath"
     "reflect"
+    "sort"
     "strings"
     "sync"
     "sync/atomic" // for int64 apiCallCount
     "time"
 
     "github.com/jawher/mow.cli"
+    "gopkg.in/yaml.v2"
     
     "cloud.google.com/go/logging" // Stackdriver logging client package
 
-    "golang.org/x/oauth2/google"
     "golang.org/x/oauth2"
+    "golang.org/x/oauth2/google"
     // v3 Drive API doesn't include domain in the permissions returned by File list for non-domain shares, 
     // so have to parse the email address
     // v3, unlike v2, doesn't return permissions for files for which user running utility only has read permissions
+    "google.golang.org/api/admin/directory/v1" // for group policy
     "google.golang.org/api/drive/v2"
     "google.golang.org/api/gmail/v1"
     "google.golang.org/api/sheets/v4"
@@ -39,29 +48,51 @@ import (
 type cliPtrStruct struct {
     subject *string
     mailTo *string 
+    notifyOwners *bool
     policySpreadsheetId *string 
-    rootId *string
+    policyFile *string
+    rootId *[]string
     itemType *string
     fix *bool
     wait *int
+    workers *int
+    quota *int
+    encryptToken *bool
+    profile *string
+    credentials *string
+    adc *bool
+    impersonate *string
+    groupPolicy *bool
+    journal *string
+    incremental *string
+    findings *string
+    digest *string
+    resultsSheet *string
+    resultsTab *string
+    checkpoint *string
+    resume *bool
+    domain *string
 }
 
 type flagStruct struct {
     Flag string
     FlagVal string
+    FlagValArr []string // set for repeatable flags
 }
 
 type itemWithPolicyStruct struct {   
     // Enable performant search via map since golang doesn't have array search
     // https://stackoverflow.com/questions/10485743/contains-method-for-a-slice
     item *drive.File
-    permittedDomainMap map[string]struct{}
+    permittedDomainMap map[string]string // domain, group or public: maximum role, empty for any
 }
 
 type permissionStruct struct {
     // Variables must be upper-case so they're exportable and available in the template
     Role string
     Response string
+    PermittedRole string // set if the share is permitted, but only with a lesser role
+    New bool // first seen since the last mail, with --findings
 }
 
 type notificationStruct struct {
@@ -71,7 +102,7 @@ type notificationStruct struct {
     Url string
     ItemType string 
     OwnerMap map[string]string  
-    PermittedDomainMap map[string]struct{}
+    PermittedDomainMap map[string]string
     PermissionMap map[string]*permissionStruct
 }
 
@@ -82,12 +113,125 @@ type notificationTemplate struct {
     FolderPolicyArr []*folderPolicyStruct
     LogArr []string
     NotificationMap map[string]*notificationStruct
+    ResolvedArr []*findingStruct
+    Owner string // set in an owner's own mail
+    OwnerCountMap map[string]int // items per owner mailed, in the mailTo report
 }
 
 type folderPolicyStruct struct {
-    Id string
-    Name string
-    Domain string
+    Id string `json:"folder" yaml:"folder"`
+    Name string `json:"-" yaml:"-"`
+    Domain string `json:"domain" yaml:"domain"` // or group email address, or public
+    Role string `json:"role,omitempty" yaml:"role,omitempty"` // maximum role; empty for any
+}
+
+// Remediation for review: written by plan, executed by apply
+type planStruct struct {
+    Created time.Time `json:"created"`
+    RootId string `json:"rootId"` // comma-separated with several roots
+    Entries []*planEntryStruct `json:"entries"`
+}
+
+type planEntryStruct struct {
+    ItemId string `json:"itemId"`
+    ItemTitle string `json:"itemTitle"`
+    ItemType string `json:"itemType"`
+    PermissionId string `json:"permissionId"`
+    // the permission as planned; apply skips it if any of these have changed
+    Type string `json:"type"`
+    EmailAddress string `json:"emailAddress,omitempty"`
+    Domain string `json:"domain,omitempty"`
+    Role string `json:"role"`
+    Action string `json:"action"` // delete or downgrade
+    PermittedRole string `json:"permittedRole,omitempty"` // downgrade to
+    Reason string `json:"reason"`
+    Owner string `json:"owner,omitempty"` // with --domain, the user apply impersonates to change it
+}
+
+// One line of the journal: a permission as it was before it was deleted or downgraded
+type journalEntryStruct struct {
+    Time time.Time `json:"time"`
+    Action string `json:"action"` // delete or downgrade
+    ItemId string `json:"itemId"`
+    ItemTitle string `json:"itemTitle"`
+    ItemType string `json:"itemType"`
+    Permission *drive.Permission `json:"permission"`
+    Owner string `json:"owner,omitempty"` // with --domain, the user restore impersonates to change it back
+}
+
+// Local copy of the tree under the root folder, for incremental runs
+type snapshotStruct struct {
+    RootId string `json:"rootId"`
+    DriveId string `json:"driveId,omitempty"` // set if the root is in a shared drive
+    PolicyHash string `json:"policyHash"` // a policy change re-evaluates every item
+    PageToken string `json:"pageToken"` // Changes feed position the snapshot is current to
+    ItemMap map[string]*drive.File `json:"items"`
+}
+
+// Progress of a scan, for --resume: the folders still to list and the items found so far
+type checkpointStruct struct {
+    RootId string `json:"rootId"` // comma-separated with several roots
+    PolicyHash string `json:"policyHash"` // a policy change scans everything
+    PageToken string `json:"pageToken,omitempty"` // with --incremental, the Changes feed position from before the scan
+    FolderArr []*checkpointEntryStruct `json:"folders"` // queued or being listed
+    ItemArr []*checkpointEntryStruct `json:"items"`
+}
+
+// An item and the domains permitted on it
+type checkpointEntryStruct struct {
+    Item *drive.File `json:"item"`
+    PermittedDomainMap map[string]string `json:"permittedDomains"`
+}
+
+// Out of policy shares across runs, so runs can be frequent and mail infrequent
+type findingsStateStruct struct {
+    LastMail time.Time `json:"lastMail"`
+    FindingMap map[string]*findingStruct `json:"findings"` // by item id and grantee
+}
+
+// One out of policy share; exportable for the resolved template
+type findingStruct struct {
+    ItemId string `json:"itemId"`
+    Name string `json:"name"`
+    Url string `json:"url"`
+    ItemType string `json:"itemType"`
+    OwnerMap map[string]string `json:"owners"`
+    PermittedDomainMap map[string]string `json:"permittedDomains"`
+    Grantee string `json:"grantee"`
+    Role string `json:"role"`
+    Response string `json:"response,omitempty"`
+    PermittedRole string `json:"permittedRole,omitempty"`
+    FirstSeen time.Time `json:"firstSeen"`
+    LastSeen time.Time `json:"lastSeen"`
+    Resolved *time.Time `json:"resolved,omitempty"`
+}
+
+// Where the policy is loaded from: the Sheets policy range, or a file which can be kept in version control
+type PolicySource interface {
+    Load() ([]*folderPolicyStruct, error)
+}
+
+type sheetsPolicySource struct {
+    spreadsheetId string
+    readRange string
+}
+
+// eg.
+// - folder: 0B1a2b3c
+//   domain: partner.com
+//   role: reader
+type yamlPolicySource struct {
+    path string
+}
+
+// eg. [{"folder": "0B1a2b3c", "domain": "partner.com", "role": "reader"}]
+type jsonPolicySource struct {
+    path string
+}
+
+// Same columns as the policy spreadsheet, including the header row
+type csvPolicySource struct {
+    path string
 }
 
 const (
@@ -98,12 +242,21 @@ const (
     pageSize int64 = 1000
     sleepSeconds = 1 
     folderMimeType = "application/vnd.google-apps.folder"   
+    itemFields = "id, title, mimeType, labels, alternateLink, owners, permissions, driveId, parents(id)"
     fatal = "Fatal"
     warning = "Warning"
     info = "Info"
     tokenFile = "token.json" 
+    checkpointInterval = time.Minute
+    encryptedTokenFile = "token.json.enc"
     driveScope = drive.DriveScope
+    deleteAction = "delete"
+    downgradeAction = "downgrade"
     mailScope = gmail.GmailSendScope 
+    policyScope = sheets.SpreadsheetsReadonlyScope
+    resultsScope = sheets.SpreadsheetsScope
+    groupScope = admin.AdminDirectoryGroupMemberReadonlyScope
+    userScope = admin.AdminDirectoryUserReadonlyScope
 )
 
 // Global options available to any of the commands
@@ -112,17 +265,20 @@ var (
     // maps and arrays can't be constants: https://stackoverflow.com/questions/18342195/how-to-declare-constant-map   
     
     apiVersion string
-    // If modifying these scopes, delete previously saved token.json
-    scopeArr = []string{sheets.SpreadsheetsReadonlyScope, drive.DriveMetadataReadonlyScope, logging.WriteScope}
+    // The oauth package re-authorizes automatically if the cached token lacks any of these scopes
+    scopeArr = []string{drive.DriveMetadataReadonlyScope, logging.WriteScope}
     
     mailHeader = map[string]string{"Subject": "",
                                     "MIME-Version": "1.0",
                                     "Content-Type": "text/html",
                                     "Content-Transfer_Encoding": "quoted-printable"}
-    templatesArr = []string{"templates/layout.html","templates/flags.html","templates/policy.html","templates/logs.html","templates/permissions.html"}
+    templatesArr = []string{"templates/layout.html","templates/flags.html","templates/policy.html","templates/logs.html","templates/permissions.html","templates/resolved.html","templates/owners.html"}
 
     folderPolicyArr []*folderPolicyStruct // to show policy in order in email
-    folderPolicyMap = make(map[string]string) // to search policy by folder id
+    folderPolicyMap = make(map[string][]*folderPolicyStruct) // to search policy by folder id; a folder may have several rows
+    groupMemberMap = make(map[string]map[string]struct{}) // members of the groups in the policy, including those of nested groups
+    // Drive roles in increasing order of access; v2 expresses commenter as reader with an additional role
+    roleRankMap = map[string]int{"reader": 1, "commenter": 2, "writer": 3, "fileOrganizer": 4, "organizer": 5, "owner": 6}
     
     // use struct instead of interface or get cast errors on arrays within it
     // use pointer to struct or get errors on append of arrays within it since not addressable
@@ -131,473 +287,2339 @@ var (
     notificationMap = make(map[string]*notificationStruct) 
     logArr []string
     templateStruct *notificationTemplate
-    rootFolder *drive.File
+    rootFolderArr []*drive.File
+    remediationPlan *planStruct // set by plan to record rather than fix
+    snapshotItemMap map[string]*drive.File // items under the root after an incremental scan
+    runId = time.Now().UTC().Format("20060102T150405Z") // identifies this run's rows in the results sheet
+    resultsHeaderArr = []interface{}{"Run", "Item id", "Item", "Type", "Owners", "Permission", "Role", "Maximum role", "Permitted domains", "Fix result"}
     cliPtr *cliPtrStruct
     //teamDrivePtr *bool
     sheetsService *sheets.Service
     driveService *drive.Service
     gmailService *gmail.Service
+    adminService *admin.Service
     logService *logging.Client
     logInfo *log.Logger
     logWarning *log.Logger
     logCritical *log.Logger
 
+    // resolved from the options in app.Before
+    credentialPath string // empty for application default credentials
+    tokenStore oauth.TokenStore
+    authFlow oauth.Flow
+
     mutex = &sync.Mutex{}
+    journalMutex = &sync.Mutex{}
+    logMutex = &sync.Mutex{} // logIt is called from the worker goroutines
     
     moreFiles bool
     apiCallCount uint64
+    retryTransport *oauth.RetryTransport
+    itemOwnerMap = make(map[string]string) // with --domain, the user impersonated to find each of their items
+    userServiceMap = make(map[string]*drive.Service) // Drive client by impersonated user
+    userServiceMutex = &sync.Mutex{}
+    visitedFolderMap map[string]*visitedFolderStruct // every folder the walk has reached, by id; guarded by mutex
+    inheritedPolicyMap = make(map[string]*inheritedPolicyStruct) // with --domain, policy inherited by folder id
+    userInheritedPolicyMap = make(map[string]*inheritedPolicyStruct) // and by user and folder id, where the user can't see every ancestor
+    inheritedPolicyMutex = &sync.Mutex{}
+    limiter *rateLimiter // shared by the workers so they stay within the Drive quota together
 
 )
 
 
 func main() {
     app := cli.App("./drivepolicy", "Drive Policy Validator and Fixer") // first argument must match executable name
-    app.Spec = "[-s] [-m] -p -r [-i] [-f] [-w]"
+    app.Spec = "[-s] [-m [-o]] [-p | --policyFile] [-r]... [-i] [-f] [-w] [--workers] [--quota] [-a] [-e] [--profile] [--credentials | --adc] [--impersonate] [-g] [--journal] [--incremental] [--findings [--digest]] [--resultsSheet [--resultsTab]] [--checkpoint [--resume]] [--domain]"
     // Define top-level global options   
     cliPtr = &cliPtrStruct{
         subject: app.StringOpt("s subject", "Out of Policy Drive Shares", "Email subject and title"),
         mailTo: app.StringOpt("m mailTo", "", "mailTo addressee"),
+        notifyOwners: app.BoolOpt("o notifyOwners", false, "also mail each owner the out of policy shares of their items; the mailTo addressee gets the full report with a summary of the owners mailed"),
         policySpreadsheetId: app.StringOpt("p policySpreadsheetId", "", "Policy spreadsheet id"), 
-        rootId: app.StringOpt("r rootId", "", "root folder id"), //  or team drive name
+        policyFile: app.StringOpt("policyFile", "", "policy file instead of a spreadsheet: .yaml, .json or .csv"),
+        rootId: app.StringsOpt("r rootId", nil, "root folder or shared drive id; repeat for several roots, eg. top-level project folders, to scan them in one run and report"),
         itemType: app.StringOpt("i itemType", "both", "file/folder/both: which type of items to validate or fix"),
         fix: app.BoolOpt("f fix", false, "fix permissions"),
-        wait: app.IntOpt("w wait", 0, "seconds each goroutine sleeps; set to 1 to prevent exceeding user queries per 100 seconds quota prior to applying for increase to 10k from default 1k: https://support.google.com/code/contact/drive_quota"),     
+        wait: app.IntOpt("w wait", 0, "deprecated and ignored: use --quota"),
+        workers: app.IntOpt("workers", 10, "folders listed concurrently"),
+        quota: app.IntOpt("quota", 1000, "Drive queries per user per 100 seconds to stay within; 1k by default, or the increase granted: https://support.google.com/code/contact/drive_quota"),
+        encryptToken: app.BoolOpt("e encryptToken", false, "encrypt the token cache with the key file in OAUTH_TOKEN_KEY_FILE or the passphrase in OAUTH_TOKEN_PASSPHRASE; migrates an existing token.json"),
+        profile: app.String(cli.StringOpt{
+            Name: "profile",
+            Value: "",
+            Desc: "named credential profile, eg. one per tenant, with its own credentials.json, token.json and default scopes",
+            EnvVar: oauth.ProfileEnv,
+        }),
+        credentials: app.StringOpt("credentials", "", "installed-app client secret or service account key file; defaults to credentials.json, or the profile's"),
+        adc: app.BoolOpt("adc", false, "use application default credentials instead of a credential file"),
+        impersonate: app.StringOpt("impersonate", "", "user to impersonate via domain-wide delegation when using a service account"),
+        journal: app.StringOpt("journal", "journal.jsonl", "append-only record of every permission -f or apply deletes or downgrades, for restore"),
+        incremental: app.StringOpt("incremental", "", "snapshot file for incremental runs: the first run scans everything and saves the snapshot, later runs only re-evaluate items which changed since"),
+        findings: app.StringOpt("findings", "", "state file recording when each out of policy share was first and last seen, and when it was resolved"),
+        digest: app.StringOpt("digest", "", "with --findings, mail a digest of new, still open and resolved shares at most this often, eg. 24h, rather than every run"),
+        resultsSheet: app.StringOpt("resultsSheet", "", "spreadsheet id to append a row to per out of policy share"),
+        resultsTab: app.StringOpt("resultsTab", "Results", "tab of the results spreadsheet; created with a header row if absent"),
+        checkpoint: app.StringOpt("checkpoint", "", "file to save the scan's progress to every minute, and delete once it completes"),
+        resume: app.BoolOpt("resume", false, "continue the scan saved in --checkpoint, eg. after a crash, rather than starting over"),
+        domain: app.StringOpt("domain", "", "also evaluate the files owned by every user in this domain, impersonating each with the service account in --credentials or --adc; files under no policy folder are skipped"),
+        groupPolicy: app.BoolOpt("g groupPolicy", false, "permit members of the groups in the policy, including nested groups, by looking them up in the Admin Directory; requires a groups admin"),
     }
 
     app.Before = func() {
 
-        var (
-            //https://stackoverflow.com/questions/37747370/golang-how-can-i-write-a-map-which-is-mixed-with-string-and-array
-            credentialMap map[string]interface{}
-            sheetRespValuesArr [][]interface{}
-            folderName string
-            )
+        // resolve options only, so the auth commands work without a policy spreadsheet or root folder
+        credentialPath = oAuthCredentialFile
+        tokenPath := tokenFile
+        encryptedTokenPath := encryptedTokenFile
+
+        if *cliPtr.profile != "" {
+            profile, err := oauth.LoadProfile(*cliPtr.profile)
+            if err != nil {
+                log.Fatalf("Unable to load profile: %v", err)
+            }
+            // a single file, even if the profile also has a credentials directory of keys for Groupcount
+            credentialPath = profile.CredentialFile()
+            tokenPath = profile.TokenFile()
+            encryptedTokenPath = profile.Path(encryptedTokenFile)
+            // request the profile's default scopes as well, eg. so -m and -f runs don't need re-consent
+            scopeArr = profile.MergeScopes(scopeArr)
+        }
 
+        if *cliPtr.policySpreadsheetId != "" {
+            scopeArr = append(scopeArr,policyScope)
+        }
         if *cliPtr.mailTo != "" {
             scopeArr = append(scopeArr,mailScope)
         }
+        if *cliPtr.resultsSheet != "" {
+            scopeArr = append(scopeArr,resultsScope)
+        }
         if *cliPtr.fix {
             scopeArr = append(scopeArr,driveScope)
         }
+        if *cliPtr.domain != "" {
+            scopeArr = append(scopeArr,userScope)
+        }
+        if *cliPtr.groupPolicy {
+            scopeArr = append(scopeArr,groupScope)
+        }
 
-        byt, err := ioutil.ReadFile(oAuthCredentialFile)
-        if err != nil {
-            log.Fatalf("Unable to read client secret file: %v", err)
-        }       
+        // not the device flow, which Google doesn't allow the Drive, Gmail or Logging scopes
+        authFlow = oauth.LoopbackFlow
+        tokenStore = oauth.NewFileTokenStore(tokenPath)
+        if *cliPtr.encryptToken {
+            encryptedStore, err := oauth.NewEncryptedFileTokenStoreFromEnv(encryptedTokenPath)
+            if err != nil {
+                log.Fatalf("Unable to create encrypted token cache: %v", err)
+            }
+            if err := oauth.MigratePlaintextToken(tokenPath, encryptedStore); err != nil {
+                log.Fatalf("Unable to encrypt token cache: %v", err)
+            }
+            tokenStore = encryptedStore
+        }
 
-        config, err := google.ConfigFromJSON(byt, scopeArr...)
-        if err != nil {
-            log.Fatalf("Unable to parse client secret file to config: %v", err)
+        if *cliPtr.credentials != "" {
+            credentialPath = *cliPtr.credentials
         }
-        client := oauth.GetClient(config)
+        if *cliPtr.adc {
+            credentialPath = "" // application default credentials
+        }
+        if err := checkCredentialFile(credentialPath); err != nil {
+            log.Fatalf("%v", err)
+        }
+    }
 
+    // auth login, auth status and auth revoke
+    oauthcmd.Mount(app.Cmd, authSetup)
 
-        // get project id 
-        if err := json.Unmarshal(byt, &credentialMap); err != nil {
-            log.Fatalf("Unable to parse credential file %v", err)
-        } else {
-            projectId := credentialMap["installed"].(map[string]interface{})["project_id"]
-            
-            // Get context and service account credential file path from GOOGLE_APPLICATION_CREDENTIALS environment variable
-            // The following statement just initializes the context service
-            ctx := context.Background()
-            // Create a client
-            //logService, err = logging.NewClient(ctx, projectId.(string))
-            //cfg, err := google.ConfigFromJSON(byt, "https://logging.googleapis.com/v2/entries:write")
-            //tokenSrc, err := google.DefaultTokenSource(oauth2.NoContext, oauthsvc.UserinfoEmailScope)
-            token, err := tokenFromFile(tokenFile)
-            if err != nil {
-                log.Fatalf("Unable to get token from file %s: %v", err)
-            } else {
-                // Based on https://www.jkawamoto.info/blogs/use-access-token-from-google-cloud-go/
-                // Stackdriver examples are based on service account credential file:                
-                // https://cloud.google.com/logging/docs/setup/go
-                // logService, err := logging.NewClient(ctx, projectId.(string), option.WithCredentials(creds))
-                // but we want to leverage the Drive & Gmail OAuth token 
+    // Specify the action to execute when the app is invoked correctly
+    app.Action = func() {
 
-                logService, err = logging.NewClient(ctx, projectId.(string), option.WithTokenSource(config.TokenSource(ctx, token)))
-                if err != nil {
-                        log.Fatalf("Unable to create Stackdriver client: %v", err)
-                } else { 
-                    logInfo = logService.Logger(logName).StandardLogger(logging.Info)
-                    logWarning = logService.Logger(logName).StandardLogger(logging.Warning)
-                    logCritical = logService.Logger(logName).StandardLogger(logging.Critical)
+        checkScanOptions()
+        setupServices()
+        scan()
+        if *cliPtr.domain != "" {
+            scanDomain()
+        }
+        report()
+    }
 
-                    sheetsService, err = sheets.New(client)
-                    if err != nil {
-                        logIt(err, "Unable to create Sheets client", fatal)  
-                    } else {
-                        sheetRespValuesArr, err = getSheetData(sheetsService, *cliPtr.policySpreadsheetId, policyRange)
-                        if err != nil {
-                            logIt(err, "Unable to retrieve policy from Sheets", fatal)
-                        } else {
-                            // need in array form to show in order in mail
-                            folderPolicyArr = getPolicyArr(sheetRespValuesArr)
-                            driveService, err = drive.New(client)
-                            if err != nil {
-                                logIt(err, "Unable to create Drive client", fatal)
-                            } else {
-                                
-                                // Get policy folder names
-                                // folderPolicyMap map[string]map[string]string
-                                for index, folder := range folderPolicyArr {
-
-                                    // need in map form to search by folder id 
-                                    folderPolicyMap[folder.Id] = folder.Domain
-
-                                    item, err := driveService.Files.Get(folder.Id).Do()
-                                    if err != nil {
-                                        folderName = "Unable to get folder: " + err.Error()
-                                    } else {                       
-                                        if item.MimeType != folderMimeType {
-                                            folderName = "Please specify a folder Id; this is a file Id: " + folder.Id  
-                                            logIt(err, folderName, warning)
-                                        } else {
-                                            folderName = item.Title
-                                            // v3 folderName = item.Name 
-                                        }
-                                    }
-                                    folderPolicyArr[index].Name = folderName
-                                }
-                                gmailService, err = gmail.New(client)
-                                if err != nil {
-                                    logIt(err, "Unable to retrieve Gmail client", fatal)
-                                }
-                            }
-                        }
-                    }
+    // Review remediation before applying it
+    app.Command("plan", "Scan and write the permissions -f would delete or downgrade to a plan file for review, without changing them", func(planCmd *cli.Cmd) {
+        planCmd.Spec = "[PLAN]"
+        planFile := planCmd.StringArg("PLAN", "plan.json", "plan file to write")
+        planCmd.Action = func() {
+            checkScanOptions()
+            *cliPtr.fix = false // record rather than fix
+            remediationPlan = &planStruct{Created: time.Now(), RootId: strings.Join(*cliPtr.rootId, ",")}
+            setupServices()
+            scan()
+            if *cliPtr.domain != "" {
+                scanDomain()
+            }
+            report()
+            writePlan(*planFile, remediationPlan)
+        }
+    })
+    app.Command("apply", "Delete or downgrade exactly the permissions in a plan file, skipping any which have changed since", func(applyCmd *cli.Cmd) {
+        applyCmd.Spec = "PLAN"
+        planFile := applyCmd.StringArg("PLAN", "", "plan file written by plan")
+        applyCmd.Action = func() {
+            applyPlan(*planFile)
+        }
+    })
+
+    app.Command("restore", "Re-create permissions deleted, or undo downgrades made, by -f or apply, from the journal", func(restoreCmd *cli.Cmd) {
+        restoreCmd.Spec = "[--list] [--since] [--item]... [--notify] [ENTRY...]"
+        list := restoreCmd.BoolOpt("list", false, "list the journal entries with their numbers instead of restoring")
+        since := restoreCmd.StringOpt("since", "", "restore every entry from this time on, eg. the start of an overzealous run: 2006-01-02T15:04:05Z07:00")
+        itemIdArr := restoreCmd.StringsOpt("item", nil, "restore every entry for this file or folder id")
+        notify := restoreCmd.BoolOpt("notify", false, "email the grantees of re-created permissions; off by default so a rollback doesn't re-notify everyone")
+        entryNumArr := restoreCmd.IntsArg("ENTRY", nil, "journal entry numbers, as shown by --list")
+        restoreCmd.Action = func() {
+            var sinceTime time.Time
+            if *since != "" {
+                var err error
+                sinceTime, err = time.Parse(time.RFC3339, *since)
+                if err != nil {
+                    log.Fatalf("Unable to parse --since: %v", err)
                 }
             }
-        }           
+            restoreJournal(*entryNumArr, sinceTime, *itemIdArr, *list, *notify)
+        }
+    })
+
+    app.Run(os.Args)        
+}
+
+// The credentials are read from one file, so fail clearly on a directory of them
+func checkCredentialFile(path string) error {
+    if info, err := os.Stat(path); err == nil && info.IsDir() {
+        return fmt.Errorf("Credentials %s is a directory; specify a single client secret or service account key file with --credentials", path)
     }
+    return nil
+}
 
-    // Specify the action to execute when the app is invoked correctly
-    app.Action = func() {
+// Optional in the spec so the other commands parse without them
+func checkScanOptions() {
+    if *cliPtr.policySpreadsheetId == "" && *cliPtr.policyFile == "" || len(*cliPtr.rootId) == 0 {
+        log.Fatalf("Please specify the policy spreadsheet id (-p) or policy file (--policyFile), and root folder id (-r)")
+    }
+    if len(*cliPtr.rootId) > 1 && *cliPtr.incremental != "" {
+        log.Fatalf("--incremental supports a single root folder (-r): the snapshot follows one drive's Changes feed")
+    }
+    if *cliPtr.domain != "" && *cliPtr.impersonate == "" {
+        log.Fatalf("--domain impersonates each user with a service account: specify --credentials with a service account key, or --adc, and --impersonate with an admin to list the users")
+    }
+    if *cliPtr.domain != "" && *cliPtr.incremental != "" {
+        log.Fatalf("--domain doesn't support --incremental: the Changes feed covers a single user")
+    }
+    // fail before scanning the roots rather than on the first user; --adc is checked when its credentials are found
+    if *cliPtr.domain != "" && credentialPath != "" {
+        byt, err := ioutil.ReadFile(credentialPath)
+        if err != nil {
+            log.Fatalf("Unable to read credentials %s: %v", credentialPath, err)
+        }
+        if !oauth.IsServiceAccount(&google.Credentials{JSON: byt}) {
+            log.Fatalf("--domain impersonates each user, which needs a service account key; %s isn't one", credentialPath)
+        }
+    }
+}
 
-        var (
-            permittedDomainMap = make(map[string]struct{})                 
-        )
+// Scan the root folders and everything below them, accumulating each item's permitted domains;
+// with --incremental, only the items which changed since the last run
+func scan() {
+
+    var pageToken string
+
+    rootFolderArr = nil
+    rootIdMap := make(map[string]struct{})
+    for _, rootId := range *cliPtr.rootId {
+        if _, ok := rootIdMap[rootId]; ok {
+            continue // repeated
+        }
+        rootIdMap[rootId] = struct{}{}
+        rootFolderArr = append(rootFolderArr, getRoot(rootId))
+    }
+    if len(rootFolderArr) > 1 {
+        rootFolderArr = topRoots(rootFolderArr, rootIdMap)
+    }
+    checkpoint := resumeCheckpoint()
+    if *cliPtr.incremental == "" {
+        scanRoots(rootFolderArr, "", checkpoint)
+        return
+    }
+
+    rootFolder := rootFolderArr[0] // checkScanOptions allows only one with --incremental
+
+    policyHash := hashPolicy()
+    snapshot, err := loadSnapshot(*cliPtr.incremental)
+    if err == nil && snapshot.RootId == rootFolder.Id {
+        scanChanges(rootFolder, snapshot, snapshot.PolicyHash != policyHash)
+    } else {
+        if err != nil && !os.IsNotExist(err) {
+            logIt(err, "Unable to load snapshot; scanning everything", warning)
+        }
+        // get the token first so changes made during the scan are picked up next time
+        if checkpoint != nil && checkpoint.PageToken != "" {
+            pageToken = checkpoint.PageToken // from before the interrupted scan
+        } else {
+            pageToken = getStartPageToken(rootFolder)
+        }
+        scanRoots(rootFolderArr, pageToken, checkpoint)
+        snapshot = &snapshotStruct{RootId: rootFolder.Id, DriveId: rootFolder.DriveId, PageToken: pageToken, ItemMap: make(map[string]*drive.File)}
+        for id, itemWithPolicy := range itemWithPolicyMap {
+            snapshot.ItemMap[id] = itemWithPolicy.item
+        }
+    }
+    snapshot.PolicyHash = policyHash
+    snapshotItemMap = snapshot.ItemMap
+    err = saveSnapshot(*cliPtr.incremental, snapshot)
+    if err != nil {
+        logIt(err, "Unable to save snapshot; the next run scans everything", warning)
+    }
+}
+
+// The roots which aren't below another root. The others are walked from that one anyway,
+// getting its policy as well as their own, so walking them from themselves too would list them twice.
+func topRoots(rootFolderArr []*drive.File, rootIdMap map[string]struct{}) []*drive.File {
 
-        item, err := driveService.Files.Get(*cliPtr.rootId).Do()
-        // v3 item, err := driveService.Files.Get(*cliPtr.rootId).Fields("id","mimeType","trashed").Do() 
+    var topRootArr []*drive.File
+
+    for _, rootFolder := range rootFolderArr {
+        if ancestorId, ok := rootAncestor(rootFolder, rootIdMap); ok {
+            logIt(nil, "Root folder " + rootFolder.Id + " is below root folder " + ancestorId + "; walking it from there", info)
+            continue
+        }
+        topRootArr = append(topRootArr, rootFolder)
+    }
+    return topRootArr
+}
+
+// The root the item is below, if any, following each of its parents up as far as the user can see
+func rootAncestor(item *drive.File, rootIdMap map[string]struct{}) (string, bool) {
+    for _, parent := range item.Parents {
+        if _, ok := rootIdMap[parent.Id]; ok {
+            return parent.Id, true
+        }
+        throttle()
+        folder, err := driveService.Files.Get(parent.Id).SupportsAllDrives(true).Fields("id, parents(id)").Do()
         if err != nil {
-           logIt(err, "Unable to get folder", fatal)
-        } else {                       
-            if item.MimeType != folderMimeType {
-              logIt(err, "Please specify a folder Id; this is a file Id: " + *cliPtr.rootId + " " + item.MimeType, fatal) 
-              
+            continue // not shared with the user, so nor are the folders above it
+        }
+        if ancestorId, ok := rootAncestor(folder, rootIdMap); ok {
+            return ancestorId, true
+        }
+    }
+    return "", false
+}
+
+// A root folder, or shared drive
+func getRoot(rootId string) *drive.File {
+
+    var rootFolder *drive.File
+
+    // a shared drive id is also the id of the drive's top-level folder
+    item, err := driveService.Files.Get(rootId).SupportsAllDrives(true).Do()
+    // v3 item, err := driveService.Files.Get(rootId).Fields("id","mimeType","trashed").Do() 
+    if err != nil {
+       logIt(err, "Unable to get folder " + rootId, fatal)
+    } else {                       
+        if item.MimeType != folderMimeType {
+          logIt(err, "Please specify a folder Id; this is a file Id: " + rootId + " " + item.MimeType, fatal) 
+          
+        } else {
+            if item.Labels.Trashed {
+            // v3 if item.Trashed {
+                logIt(err, "Please specify an active folder; this folder is trashed: " + rootId, fatal) 
             } else {
-                if item.Labels.Trashed {
-                // v3 if item.Trashed {
-                    logIt(err, "Please specify an active folder; this folder is trashed: " + *cliPtr.rootId, fatal) 
-                } else {
-                    rootFolder := item
-                    if _, ok := folderPolicyMap[item.Id]; ok { // https://stackoverflow.com/questions/2050391/how-to-check-if-a-map-contains-a-key-in-go
-                        permittedDomainMap[folderPolicyMap[item.Id]] = struct{}{}
-                    }
-                    folderPermissions(rootFolder, permittedDomainMap)
-                }
+                rootFolder = item
             }
         }
-          
     }
+    return rootFolder
+}
 
-    app.After = func() {
+// Walk the roots together, so an item under several is evaluated once with the union of their policy.
+// With a checkpoint, continue the scan it saved; pageToken is saved in any checkpoints.
+func scanRoots(rootFolderArr []*drive.File, pageToken string, checkpoint *checkpointStruct) {
 
-        apiCallCount := atomic.LoadUint64(&apiCallCount)
-        logIt(nil, fmt.Sprintf("%s %d","API Call Count: ", apiCallCount), info)
+    var (
+        jobArr []*folderJobStruct
+        err error
+    )
 
-        // Validate permissions against policy
-        mutex.Lock()
-        validatePermissions(itemWithPolicyMap)
-        mutex.Unlock()
+    if checkpoint != nil {
+        // the roots, and shared drives' members, are among the items found
+        walkFolders(nil, pageToken, checkpoint)
+        return
+    }
 
-        if *cliPtr.mailTo != "" {
-            mailHeader["To"] = *cliPtr.mailTo
-            mailHeader["Subject"] = *cliPtr.subject
-            sendMailFromTemplate(mailHeader, folderPolicyArr, logArr, notificationMap)
+    for _, rootFolder := range rootFolderArr {
+        permittedDomainMap := make(map[string]string)
+        for _, policy := range folderPolicyMap[rootFolder.Id] {
+            permitRole(permittedDomainMap, policy.Domain, policy.Role)
+        }
+        if isSharedDrive(rootFolder) {
+            // the drive's permissions are its members, who have access to every item in it;
+            // validate them against the policy for the drive id
+            rootFolder.Permissions, err = listPermissions(rootFolder)
+            if err != nil {
+                logIt(err, "Unable to list shared drive members", fatal)
+            }
+            upsertItemDetail(rootFolder, permittedDomainMap)
         }
-        logService.Close()
+        jobArr = append(jobArr, &folderJobStruct{rootFolder, permittedDomainMap})
     }
+    walkFolders(jobArr, pageToken, nil)
+}
 
-    app.Run(os.Args)        
+// The checkpoint to continue from with --resume, or nil to scan everything
+func resumeCheckpoint() *checkpointStruct {
+
+    if !*cliPtr.resume {
+        return nil
+    }
+    checkpoint, err := loadCheckpoint(*cliPtr.checkpoint)
+    switch {
+    case os.IsNotExist(err):
+        logIt(nil, "No checkpoint to resume; scanning everything", warning)
+    case err != nil:
+        logIt(err, "Unable to load checkpoint; scanning everything", warning)
+    case checkpoint.RootId != strings.Join(*cliPtr.rootId, ","):
+        logIt(nil, "The checkpoint is for other root folders; scanning everything", warning)
+    case checkpoint.PolicyHash != hashPolicy():
+        logIt(nil, "The policy has changed since the checkpoint; scanning everything", warning)
+    default:
+        return checkpoint
+    }
+    return nil
 }
 
+// Save the folders still to list and the items found so far.
+// Holds mutex so the items and queue are consistent: every folder found is either queued, being listed or listed.
+func writeCheckpoint(queue *folderQueue, policyHash string, pageToken string) error {
+
+    checkpoint := &checkpointStruct{RootId: strings.Join(*cliPtr.rootId, ","), PolicyHash: policyHash, PageToken: pageToken}
 
-// From go oauth package
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-    f, err := os.Open(file)
+    mutex.Lock()
+    queue.mutex.Lock()
+    for _, job := range queue.jobArr {
+        checkpoint.FolderArr = append(checkpoint.FolderArr, &checkpointEntryStruct{job.folder, job.permittedDomainMap})
+    }
+    // relisted on resume, since some of their items may not have been found yet
+    for job := range queue.activeMap {
+        checkpoint.FolderArr = append(checkpoint.FolderArr, &checkpointEntryStruct{job.folder, job.permittedDomainMap})
+    }
+    queue.mutex.Unlock()
+    for _, itemWithPolicy := range itemWithPolicyMap {
+        checkpoint.ItemArr = append(checkpoint.ItemArr, &checkpointEntryStruct{itemWithPolicy.item, itemWithPolicy.permittedDomainMap})
+    }
+    // marshal before unlocking, since upsertItemDetail adds to permitted domain maps
+    byt, err := json.Marshal(checkpoint)
+    mutex.Unlock()
     if err != nil {
-            return nil, err
+        return err
     }
-    defer f.Close()
-    tok := &oauth2.Token{}
-    err = json.NewDecoder(f).Decode(tok)
-    return tok, err
+    return writePrivateFile(*cliPtr.checkpoint, byt)
 }
 
-func folderPermissions(folder *drive.File, permittedDomainMap map[string]struct{}) {
-       
+func loadCheckpoint(checkpointFile string) (*checkpointStruct, error) {
+
+    checkpoint := &checkpointStruct{}
+    byt, err := ioutil.ReadFile(checkpointFile)
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(byt, checkpoint); err != nil {
+        return nil, err
+    }
+    if len(checkpoint.ItemArr) == 0 {
+        return nil, errors.New("Incomplete checkpoint " + checkpointFile)
+    }
+    return checkpoint, nil
+}
+
+// Policy a folder passes down: the domains permitted on it, including those from its ancestors
+type inheritedPolicyStruct struct {
+    permittedDomainMap map[string]string
+    hasPolicy bool // a policy folder is the folder itself or one of its ancestors
+    complete bool // every ancestor could be seen
+}
+
+// Evaluate the files every active user in --domain owns, as well as those under the root,
+// by impersonating each user in turn; --workers users at a time
+func scanDomain() {
+
     var (
-        fileArr []*drive.File
-        nextPageToken  string = ""  
-        itemPermittedDomainMap map[string]struct{}            
+        wgWorkers sync.WaitGroup
+        userCount, skippedCount uint64
     )
 
-    //get files in folder
+    userArr, err := listDomainUsers(*cliPtr.domain)
+    if err != nil {
+        logIt(err, "Unable to list users in " + *cliPtr.domain, fatal)
+    }
+
+    userChan := make(chan string)
+    for i := 0; i < *cliPtr.workers; i++ {
+        wgWorkers.Add(1)
+        go func() {
+            defer wgWorkers.Done()
+            for userEmail := range userChan {
+                var skipped uint64
+                service, err := userDriveService(userEmail)
+                if err == nil {
+                    skipped, err = scanUserFiles(userEmail, service)
+                }
+                atomic.AddUint64(&skippedCount, skipped)
+                if err != nil {
+                    logIt(err, "Unable to scan the files of " + userEmail + "; ", warning)
+                    continue
+                }
+                atomic.AddUint64(&userCount, 1)
+            }
+        }()
+    }
+    for _, userEmail := range userArr {
+        userChan <- userEmail
+    }
+    close(userChan)
+    wgWorkers.Wait()
+    logIt(nil, fmt.Sprintf("Scanned the files of %d of %d users in %s; skipped %d files under no policy folder", 
+        atomic.LoadUint64(&userCount), len(userArr), *cliPtr.domain, atomic.LoadUint64(&skippedCount)), info)
+}
+
+// Primary email addresses of the domain's users, except suspended and archived ones
+func listDomainUsers(domain string) ([]string, error) {
+
+    var (
+        userArr []string
+        nextPageToken string = ""
+    )
 
-    // don't do initial file read concurrently with go routines or will exceed quota
-    // var wgFiles sync.WaitGroup // declare here so get new one for each recursion level
-    // moreFiles = true
     for {
-        //wgFiles.Add(1)
-        //go func() {
-        qArr := []string{"'",folder.Id,"' in parents and trashed = false"}
-        qString := strings.Join(qArr,"")
-        atomic.AddUint64(&apiCallCount, 1)
-        r, err := driveService.Files.List().Q(qString).PageToken(nextPageToken). 
-                        MaxResults(pageSize).Fields("nextPageToken, items(id, title, mimeType, labels, alternateLink, owners, permissions)").Do()
-                        // v3 PageSize(pageSize).Fields("nextPageToken, files(id, name, mimeType, webViewLink, owners, permissions)").Do()
+        atomic.AddUint64(&apiCallCount, 1) // Directory quota, so not throttled
+        r, err := adminService.Users.List().Domain(domain).MaxResults(500).PageToken(nextPageToken).
+                    Fields("nextPageToken, users(primaryEmail, suspended, archived)").Do()
         if err != nil {
-            if gapiErr, ok := err.(*googleapi.Error); ok {
-                if gapiErr.Code == 500 { // internal error
-                    // retry once after 1 second: implement own retry since backoff libraries may not be threadsafe
-                    time.Sleep(time.Second)
-                    atomic.AddUint64(&apiCallCount, 1)
-                    r, err = driveService.Files.List().Q(qString).PageToken(nextPageToken).  
-                                MaxResults(pageSize).Fields("nextPageToken, items(id, title, mimeType, labels, alternateLink, owners, permissions)").Do()
-                                // v3 PageSize(pageSize).Fields("nextPageToken, files(id, name, mimeType, webViewLink, owners, permissions)").Do()
-                } 
-            }          
-        } 
-        if err != nil {
-            logIt(err, "Unable to list files in folder " + folder.Id + "; ", warning)
-            /*mutex.Lock()
-            moreFiles = false
-            mutex.Unlock()*/
-            break
+            return nil, err
+        }
+        for _, user := range r.Users {
+            if !user.Suspended && !user.Archived {
+                userArr = append(userArr, user.PrimaryEmail)
+            }
         }
-        
-        //mutex.Lock()
-        fileArr = append(fileArr,r.Items...)
-        // v3 fileArr = append(fileArr,r.Files...)
-        //mutex.Unlock()
         nextPageToken = r.NextPageToken
         if nextPageToken == "" {
-            /*mutex.Lock()
-            moreFiles = false
-            mutex.Unlock()*/
             break
         }
+    }
+    return userArr, nil
+}
 
-        //wgFiles.Done()
-        //}()
+// Drive client impersonating the user, via the service account's domain-wide delegation; one per user
+func userDriveService(userEmail string) (*drive.Service, error) {
+
+    // the lock covers only the map, so one user's token exchange doesn't hold up the workers on other users
+    userServiceMutex.Lock()
+    service, ok := userServiceMap[userEmail]
+    userServiceMutex.Unlock()
+    if ok {
+        return service, nil
     }
-    //wgFiles.Wait()
-    //}
-       
-    
-    // https://golang.org/src/sync/example_test.go
-    var wgChildren sync.WaitGroup // declare here so get new one for each recursion level
-    for _, item := range fileArr {
 
-        mutex.Lock()
-        // set local tree of permitted domains for each item separately
-        // otherwise aggregate across items
-        itemPermittedDomainMap = make(map[string]struct{}) 
-        for domain, _ := range permittedDomainMap {
-           itemPermittedDomainMap[domain] = struct{}{}
+    userScopeArr := []string{drive.DriveMetadataReadonlyScope}
+    for _, scope := range scopeArr {
+        // with -f, apply and restore
+        if scope == driveScope {
+            userScopeArr = append(userScopeArr, driveScope)
+            break
         }
+    }
+    creds, err := oauth.FindCredentials(retryContext(), 
+        oauth.CredentialOptions{File: credentialPath, Subject: userEmail, Scopes: userScopeArr})
+    if err != nil {
+        return nil, err
+    }
+    if !oauth.IsServiceAccount(creds) {
+        // user credentials would silently act as the same user for everyone
+        return nil, errors.New("Impersonating users requires a service account key")
+    }
+    service, err = drive.New(oauth2.NewClient(retryContext(), creds.TokenSource))
+    if err != nil {
+        return nil, err
+    }
+    userServiceMutex.Lock()
+    defer userServiceMutex.Unlock()
+    // another worker may have made one for the same user meanwhile; keep the first
+    if existing, ok := userServiceMap[userEmail]; ok {
+        return existing, nil
+    }
+    userServiceMap[userEmail] = service
+    return service, nil
+}
 
-        // add permitted domains for current folder
-        if item.MimeType == folderMimeType {
-            if _, ok := folderPolicyMap[item.Id]; ok { // https://stackoverflow.com/questions/2050391/how-to-check-if-a-map-contains-a-key-in-go
-                // need to do this before call go routine to avoid it pushing up the stack
-                itemPermittedDomainMap[folderPolicyMap[item.Id]] = struct{}{}
-            }
-        }
-       
+// Add the files the impersonated user owns, with the policy of the folders they're in, to itemWithPolicyMap.
+// Returns the number skipped for being under no policy folder, since no policy permits or forbids their shares.
+func scanUserFiles(userEmail string, service *drive.Service) (uint64, error) {
 
-        wgChildren.Add(1)
-        // go validateChildren(folderId, permittedDomainMap, fileArr)
-        // pass in variables explicitly so they have correct scope or will null out
-        go func(item *drive.File, permittedDomainMap map[string]struct{}) { 
-            // permittedDomainMap has local scope since golang doesn't have pass by reference. even for maps
-            // use defer wgChildren.Done() here if one of the child routines could error out before end of func
-            
-            if item.MimeType == folderMimeType {
-                folderPermissions(item, permittedDomainMap)
+    var (
+        nextPageToken string = ""
+        skipped uint64
+    )
+
+    for {
+        throttle()
+        // shared drive files are owned by the drive, so this is My Drive only
+        r, err := service.Files.List().Q("'me' in owners and trashed = false").PageToken(nextPageToken).
+                    MaxResults(pageSize).Fields("nextPageToken, items(" + itemFields + ")").Do()
+        if err != nil {
+            return skipped, err
+        }
+        for _, item := range r.Items {
+            permittedDomainMap, hasPolicy := itemPolicy(userEmail, service, item)
+            if !hasPolicy {
+                skipped++
+                continue
             }
-              
-            wgChildren.Done()
-        }(item, itemPermittedDomainMap)
+            mutex.Lock()
+            upsertItemDetail(item, permittedDomainMap)
+            itemOwnerMap[item.Id] = userEmail
+            mutex.Unlock()
+        }
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            break
+        }
+    }
+    return skipped, nil
+}
 
-        // do this after have already incremented the permissions  
-        // and before call async goroutines which could change permittedDomainMap up the tree by reference           
-        //validatePermissions(item, permittedDomainMap) 
-        //validatePermissions(item, itemPermittedDomainMap) 
-        upsertItemDetail(item, itemPermittedDomainMap) 
-        mutex.Unlock()
+// Domains permitted on an item found outside the roots, from the policy folders above it, and whether there are any
+func itemPolicy(userEmail string, service *drive.Service, item *drive.File) (map[string]string, bool) {
 
-        // prevent exceeding 1k requests per user per 100 seconds quota: limits to < 600 requests / 100 seconds
-        if *cliPtr.wait != 0 {
-            time.Sleep(time.Duration(*cliPtr.wait) * time.Second)
+    permittedDomainMap := make(map[string]string)
+    hasPolicy := false
+    if item.MimeType == folderMimeType {
+        for _, policy := range folderPolicyMap[item.Id] {
+            permitRole(permittedDomainMap, policy.Domain, policy.Role)
+            hasPolicy = true
         }
-
     }
-    wgChildren.Wait()
-        
+    // like a file with several parents in the tree, permitted by any of them
+    for _, parent := range item.Parents {
+        inheritedPolicy := folderInheritedPolicy(userEmail, service, parent.Id)
+        for domain, role := range inheritedPolicy.permittedDomainMap {
+            permitRole(permittedDomainMap, domain, role)
+        }
+        hasPolicy = hasPolicy || inheritedPolicy.hasPolicy
+    }
+    return permittedDomainMap, hasPolicy
 }
 
-// Accumulate prior to validation since a file/folder with multiple parents 
-// may have valid permittedDomains on one of the parent's ancestors which then apply to the file/folder
-// even though it doesn't have them on the other parent's ancestors.
-func upsertItemDetail(item *drive.File, permittedDomainMap map[string]struct{}) {
-
-    var (      
-        id string = item.Id  
-    )
+// Policy the folder passes down, looking up its ancestors as the user. Cached whether or not there's any policy,
+// for every user if every ancestor could be seen, else for this user only, since another user may see the ones this user can't.
+func folderInheritedPolicy(userEmail string, service *drive.Service, folderId string) *inheritedPolicyStruct {
+
+    userKey := userEmail + " " + folderId
+    inheritedPolicyMutex.Lock()
+    inheritedPolicy, ok := inheritedPolicyMap[folderId]
+    if !ok {
+        inheritedPolicy, ok = userInheritedPolicyMap[userKey]
+    }
+    inheritedPolicyMutex.Unlock()
+    if ok {
+        return inheritedPolicy
+    }
+
+    inheritedPolicy = &inheritedPolicyStruct{permittedDomainMap: make(map[string]string), complete: true}
+    for _, policy := range folderPolicyMap[folderId] {
+        permitRole(inheritedPolicy.permittedDomainMap, policy.Domain, policy.Role)
+        inheritedPolicy.hasPolicy = true
+    }
+
+    throttle()
+    folder, err := service.Files.Get(folderId).SupportsAllDrives(true).Fields("id, parents(id)").Do()
+    if err != nil {
+        inheritedPolicy.complete = false
+    } else {
+        for _, parent := range folder.Parents {
+            parentPolicy := folderInheritedPolicy(userEmail, service, parent.Id)
+            for domain, role := range parentPolicy.permittedDomainMap {
+                permitRole(inheritedPolicy.permittedDomainMap, domain, role)
+            }
+            inheritedPolicy.hasPolicy = inheritedPolicy.hasPolicy || parentPolicy.hasPolicy
+            inheritedPolicy.complete = inheritedPolicy.complete && parentPolicy.complete
+        }
+    }
+
+    inheritedPolicyMutex.Lock()
+    if inheritedPolicy.complete {
+        inheritedPolicyMap[folderId] = inheritedPolicy
+    } else {
+        userInheritedPolicyMap[userKey] = inheritedPolicy
+    }
+    inheritedPolicyMutex.Unlock()
+    return inheritedPolicy
+}
+
+// The Drive client to change an item with: its owner's if it was found by impersonating them
+func itemDriveService(itemId string) (*drive.Service, error) {
+    return ownerDriveService(itemOwnerMap[itemId])
+}
+
+// The impersonated owner's Drive client, or the run's if there's no owner
+func ownerDriveService(owner string) (*drive.Service, error) {
+    if owner == "" {
+        return driveService, nil
+    }
+    return userDriveService(owner)
+}
+
+// Apply the Changes feed since the snapshot, then re-evaluate the changed items and everything below changed folders,
+// eg. a folder moved between policy folders
+func scanChanges(rootFolder *drive.File, snapshot *snapshotStruct, policyChanged bool) {
+
+    var (
+        nextPageToken string = snapshot.PageToken
+        changedMap = make(map[string]struct{})
+        newFolderArr []*drive.File
+        err error
+    )
+
+    for {
+        throttle()
+        r, err := listChangesCall(snapshot, nextPageToken).Do()
+        if err != nil {
+            logIt(err, "Unable to list changes; delete " + *cliPtr.incremental + " to scan everything", fatal)
+        }
+        for _, change := range r.Items {
+            file := change.File
+            if change.Deleted || file == nil || file.Labels != nil && file.Labels.Trashed {
+                // removed, trashed or no longer accessible; its descendants are pruned below
+                delete(snapshot.ItemMap, change.FileId)
+                continue
+            }
+            if file.Id == rootFolder.Id {
+                continue
+            }
+            if _, known := snapshot.ItemMap[file.Id]; !known && file.MimeType == folderMimeType {
+                newFolderArr = append(newFolderArr, file)
+            }
+            // the feed covers the whole drive; items outside the root are pruned below
+            snapshot.ItemMap[file.Id] = file
+            changedMap[file.Id] = struct{}{}
+        }
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            snapshot.PageToken = r.NewStartPageToken
+            break
+        }
+    }
+
+    pruneSnapshot(snapshot, rootFolder.Id)
+    // folders moved in from outside the root bring their contents with them
+    for _, folder := range newFolderArr {
+        if _, ok := snapshot.ItemMap[folder.Id]; ok {
+            addSubtree(folder, snapshot, changedMap)
+        }
+    }
+    if isSharedDrive(rootFolder) {
+        // membership changes aren't reported as file changes, so always re-evaluate the members
+        rootFolder.Permissions, err = listPermissions(rootFolder)
+        if err != nil {
+            logIt(err, "Unable to list shared drive members", fatal)
+        }
+        snapshot.ItemMap[rootFolder.Id] = rootFolder
+        changedMap[rootFolder.Id] = struct{}{}
+    }
+    for id, _ := range changedMap {
+        item, ok := snapshot.ItemMap[id]
+        if ok && item.DriveId != "" && !isSharedDrive(item) {
+            // Changes and Files.List don't return permissions for shared drive items
+            item.Permissions, err = listPermissions(item)
+            if err != nil {
+                logIt(err, "Unable to list permissions for item " + item.Id + "; ", warning)
+            }
+        }
+    }
+
+    logIt(nil, fmt.Sprintf("Incremental scan: %d changed items of %d", len(changedMap), len(snapshot.ItemMap)), info)
+    evaluateSnapshot(rootFolder, snapshot, changedMap, policyChanged)
+}
+
+// Recompute each item's permitted domains from the snapshot as folderPermissions does,
+// and upsert those of the changed items, the items below changed folders, or every item if the policy changed
+func evaluateSnapshot(rootFolder *drive.File, snapshot *snapshotStruct, changedMap map[string]struct{}, policyChanged bool) {
+
+    var (
+        childMap = getChildMap(snapshot)
+        permittedMap = make(map[string]map[string]string) // across all parents
+        affectedMap = make(map[string]struct{})
+        rootPermittedDomainMap = make(map[string]string)
+        walk func(folderId string, permittedDomainMap map[string]string, affected bool)
+    )
+
+    for _, policy := range folderPolicyMap[rootFolder.Id] {
+        permitRole(rootPermittedDomainMap, policy.Domain, policy.Role)
+    }
+    if isSharedDrive(rootFolder) {
+        permittedMap[rootFolder.Id] = rootPermittedDomainMap
+        affectedMap[rootFolder.Id] = struct{}{}
+    }
+
+    walk = func(folderId string, permittedDomainMap map[string]string, affected bool) {
+        for _, item := range childMap[folderId] {
+            itemPermittedDomainMap := make(map[string]string)
+            for domain, role := range permittedDomainMap {
+                itemPermittedDomainMap[domain] = role
+            }
+            if item.MimeType == folderMimeType {
+                for _, policy := range folderPolicyMap[item.Id] {
+                    permitRole(itemPermittedDomainMap, policy.Domain, policy.Role)
+                }
+            }
+            if permittedMap[item.Id] == nil {
+                permittedMap[item.Id] = make(map[string]string)
+            }
+            for domain, role := range itemPermittedDomainMap {
+                permitRole(permittedMap[item.Id], domain, role)
+            }
+
+            _, changed := changedMap[item.Id]
+            itemAffected := affected || changed || policyChanged
+            if itemAffected {
+                affectedMap[item.Id] = struct{}{}
+            }
+            if item.MimeType == folderMimeType {
+                walk(item.Id, itemPermittedDomainMap, itemAffected)
+            }
+        }
+    }
+    walk(rootFolder.Id, rootPermittedDomainMap, false)
+
+    for id, _ := range affectedMap {
+        upsertItemDetail(snapshot.ItemMap[id], permittedMap[id])
+    }
+}
+
+// Children of each folder in the snapshot; an item with several parents is listed under each
+func getChildMap(snapshot *snapshotStruct) map[string][]*drive.File {
+    childMap := make(map[string][]*drive.File)
+    for _, item := range snapshot.ItemMap {
+        for _, parent := range item.Parents {
+            childMap[parent.Id] = append(childMap[parent.Id], item)
+        }
+    }
+    return childMap
+}
+
+// Drop the items no longer below the root, eg. moved out of it or below a deleted folder
+func pruneSnapshot(snapshot *snapshotStruct, rootId string) {
+
+    childMap := getChildMap(snapshot)
+    reachedMap := map[string]struct{}{rootId: struct{}{}}
+    folderIdArr := []string{rootId}
+    for len(folderIdArr) > 0 {
+        folderId := folderIdArr[0]
+        folderIdArr = folderIdArr[1:]
+        for _, item := range childMap[folderId] {
+            if _, ok := reachedMap[item.Id]; !ok {
+                reachedMap[item.Id] = struct{}{}
+                folderIdArr = append(folderIdArr, item.Id)
+            }
+        }
+    }
+    for id, _ := range snapshot.ItemMap {
+        if _, ok := reachedMap[id]; !ok {
+            delete(snapshot.ItemMap, id)
+        }
+    }
+}
+
+// List a folder which is new to the snapshot, and everything below it
+func addSubtree(folder *drive.File, snapshot *snapshotStruct, changedMap map[string]struct{}) {
+
+    var nextPageToken string = ""
+
+    for {
+        throttle()
+        r, err := listFilesCall(folder, "'" + folder.Id + "' in parents and trashed = false", nextPageToken).Do()
+        if err != nil {
+            logIt(err, "Unable to list files in folder " + folder.Id + "; ", warning)
+            return
+        }
+        for _, item := range r.Items {
+            _, known := snapshot.ItemMap[item.Id]
+            snapshot.ItemMap[item.Id] = item
+            changedMap[item.Id] = struct{}{}
+            if !known && item.MimeType == folderMimeType {
+                addSubtree(item, snapshot, changedMap)
+            }
+        }
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            return
+        }
+    }
+}
+
+func getStartPageToken(rootFolder *drive.File) string {
+
+    call := driveService.Changes.GetStartPageToken().SupportsAllDrives(true)
+    if rootFolder.DriveId != "" {
+        call = call.DriveId(rootFolder.DriveId)
+    }
+    throttle()
+    r, err := call.Do()
+    if err != nil {
+        logIt(err, "Unable to get changes start page token", fatal)
+    }
+    return r.StartPageToken
+}
+
+// Changes in the root's shared drive, or in My Drive
+func listChangesCall(snapshot *snapshotStruct, pageToken string) *drive.ChangesListCall {
+    call := driveService.Changes.List().PageToken(pageToken).MaxResults(pageSize).
+                IncludeRemoved(true).SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+                Fields("nextPageToken, newStartPageToken, items(fileId, deleted, file(" + itemFields + "))")
+    if snapshot.DriveId != "" {
+        call = call.DriveId(snapshot.DriveId)
+    }
+    return call
+}
+
+// Everything validation depends on besides the items: policy, group members and item type
+func hashPolicy() string {
+
+    byt, err := json.Marshal(struct {
+        Policy []*folderPolicyStruct
+        Groups map[string]map[string]struct{}
+        ItemType string
+    }{folderPolicyArr, groupMemberMap, *cliPtr.itemType})
+    if err != nil {
+        logIt(err, "Unable to hash policy", fatal)
+    }
+    sum := sha256.Sum256(byt)
+    return hex.EncodeToString(sum[:])
+}
+
+func loadSnapshot(snapshotFile string) (*snapshotStruct, error) {
+
+    snapshot := &snapshotStruct{}
+    byt, err := ioutil.ReadFile(snapshotFile)
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(byt, snapshot); err != nil {
+        return nil, err
+    }
+    if snapshot.ItemMap == nil || snapshot.PageToken == "" {
+        return nil, errors.New("Incomplete snapshot " + snapshotFile)
+    }
+    return snapshot, nil
+}
+
+func saveSnapshot(snapshotFile string, snapshot *snapshotStruct) error {
+
+    byt, err := json.Marshal(snapshot)
+    if err != nil {
+        return err
+    }
+    return writePrivateFile(snapshotFile, byt)
+}
+
+// Write to a temporary file in the same directory, readable only by the current user, then rename it,
+// so an interrupted run never leaves a truncated file. For files which list who has access to what.
+func writePrivateFile(path string, byt []byte) error {
+
+    file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+    if err != nil {
+        return err
+    }
+    // harmless after the rename
+    defer os.Remove(file.Name())
+    if err := file.Chmod(0600); err != nil {
+        file.Close()
+        return err
+    }
+    if _, err := file.Write(byt); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Close(); err != nil {
+        return err
+    }
+    return os.Rename(file.Name(), path)
+}
+
+// Credentials and Stackdriver logging; returns the client for the API services
+func setupClient() *http.Client {
+
+    // retry transient errors, including rate limits, beneath the OAuth transport so every API client
+    // and token refresh shares it
+    retryTransport = oauth.NewRetryTransport(nil)
+    // installed-app secret, service account key (optionally impersonating a user) or application default credentials
+    creds, err := oauth.FindCredentials(retryContext(), 
+        oauth.CredentialOptions{File: credentialPath, Subject: *cliPtr.impersonate, Scopes: scopeArr},
+        oauth.WithTokenStore(tokenStore), oauth.WithFlow(authFlow))
+    if err != nil {
+        log.Fatalf("Unable to get credentials: %v", err)
+    }
+    // share one token source between the API clients and Stackdriver
+    // so a refreshed token is saved back to token.json once
+    tokenSource := creds.TokenSource
+    client := oauth2.NewClient(retryContext(), tokenSource)
+
+    // get project id 
+    projectId := creds.ProjectID
+    if projectId == "" {
+        // eg. application default credentials from gcloud don't carry a project
+        projectId = os.Getenv("GOOGLE_CLOUD_PROJECT")
+    }
+    if projectId == "" {
+        log.Fatalf("Unable to determine the project for Stackdriver logging; set GOOGLE_CLOUD_PROJECT")
+    }
+    // Get context and service account credential file path from GOOGLE_APPLICATION_CREDENTIALS environment variable
+    // The following statement just initializes the context service
+    ctx := context.Background()
+    // Create a client
+    //logService, err = logging.NewClient(ctx, projectId)
+    //cfg, err := google.ConfigFromJSON(byt, "https://logging.googleapis.com/v2/entries:write")
+    //tokenSrc, err := google.DefaultTokenSource(oauth2.NoContext, oauthsvc.UserinfoEmailScope)
+    // Based on https://www.jkawamoto.info/blogs/use-access-token-from-google-cloud-go/
+    // Stackdriver examples are based on service account credential file:                
+    // https://cloud.google.com/logging/docs/setup/go
+    // logService, err := logging.NewClient(ctx, projectId, option.WithCredentials(creds))
+    // but we want to leverage the Drive & Gmail OAuth token 
+
+    logService, err = logging.NewClient(ctx, projectId, option.WithTokenSource(tokenSource))
+    if err != nil {
+        log.Fatalf("Unable to create Stackdriver client: %v", err)
+    }
+    logInfo = logService.Logger(logName).StandardLogger(logging.Info)
+    logWarning = logService.Logger(logName).StandardLogger(logging.Warning)
+    logCritical = logService.Logger(logName).StandardLogger(logging.Critical)
+
+    return client
+}
+
+// Context whose OAuth clients retry transient errors, including rate limits, via retryTransport
+func retryContext() context.Context {
+    return context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: retryTransport})
+}
+
+// Credentials, Stackdriver, Sheets, Drive and Gmail clients and the policy
+func setupServices() {
+
+    var (
+        folderName string
+        )
+
+    client := setupClient()
+
+    policySource, err := newPolicySource(client)
+    if err != nil {
+        logIt(err, "Unable to create policy source", fatal)  
+    } else {
+        // need in array form to show in order in mail
+        folderPolicyArr, err = policySource.Load()
+        if err != nil {
+            logIt(err, "Unable to retrieve policy", fatal)
+        } else {
+            driveService, err = drive.New(client)
+            if err != nil {
+                logIt(err, "Unable to create Drive client", fatal)
+            } else {
+                if *cliPtr.wait != 0 {
+                    logIt(nil, "-w is deprecated and ignored; queries are limited to --quota per 100 seconds", warning)
+                }
+                if *cliPtr.workers < 1 || *cliPtr.quota < 1 {
+                    logIt(nil, "--workers and --quota must be at least 1", fatal)
+                }
+                limiter = newRateLimiter(*cliPtr.quota)
+                
+                // Get policy folder names
+                for index, folder := range folderPolicyArr {
+
+                    // need in map form to search by folder id 
+                    folderPolicyMap[folder.Id] = append(folderPolicyMap[folder.Id], folder)
+
+                    item, err := driveService.Files.Get(folder.Id).SupportsAllDrives(true).Do()
+                    if err != nil {
+                        folderName = "Unable to get folder: " + err.Error()
+                    } else {                       
+                        if item.MimeType != folderMimeType {
+                            folderName = "Please specify a folder Id; this is a file Id: " + folder.Id  
+                            logIt(err, folderName, warning)
+                        } else if isSharedDrive(item) {
+                            sharedDrive, err := driveService.Drives.Get(item.Id).Do()
+                            if err != nil {
+                                folderName = "Unable to get shared drive: " + err.Error()
+                            } else {
+                                folderName = sharedDrive.Name
+                            }
+                        } else {
+                            folderName = item.Title
+                            // v3 folderName = item.Name 
+                        }
+                    }
+                    folderPolicyArr[index].Name = folderName
+                }
+                gmailService, err = gmail.New(client)
+                if err != nil {
+                    logIt(err, "Unable to retrieve Gmail client", fatal)
+                }
+                if *cliPtr.resultsSheet != "" && sheetsService == nil {
+                    sheetsService, err = sheets.New(client)
+                    if err != nil {
+                        logIt(err, "Unable to create Sheets client", fatal)
+                    }
+                }
+                setupGroupPolicy(client)
+                if *cliPtr.domain != "" && adminService == nil {
+                    adminService, err = admin.New(client)
+                    if err != nil {
+                        logIt(err, "Unable to create Admin Directory client", fatal)
+                    }
+                }
+            }
+        }
+    }
+}
+
+// Validate, mail and close the log once the scan is complete
+func report() {
+
+    apiCallCount := atomic.LoadUint64(&apiCallCount)
+    logIt(nil, fmt.Sprintf("%s %d","API Call Count: ", apiCallCount), info)
+    if retryCountMap := retryTransport.Counts(); len(retryCountMap) > 0 {
+        logIt(nil, fmt.Sprintf("Retries by reason: %v", retryCountMap), info)
+    }
+
+    // Validate permissions against policy
+    mutex.Lock()
+    validatePermissions(itemWithPolicyMap)
+    mutex.Unlock()
+
+    if *cliPtr.resultsSheet != "" {
+        err := writeResults(*cliPtr.resultsSheet, *cliPtr.resultsTab)
+        if err != nil {
+            logIt(err, "Unable to write results to sheet", warning)
+        }
+    }
+
+    if *cliPtr.findings == "" {
+        if *cliPtr.mailTo != "" {
+            mailReport(notificationMap, nil)
+        }
+    } else {
+        reportFindings()
+    }
+    logService.Close()
+}
+
+// Mail the report to the mailTo addressee and, with -o, each owner their own items
+func mailReport(notificationMap map[string]*notificationStruct, resolvedArr []*findingStruct) {
+
+    var ownerCountMap map[string]int
+
+    if *cliPtr.notifyOwners {
+        ownerCountMap = make(map[string]int)
+        ownerMap, skippedArr := ownerNotifications(notificationMap, folderPolicyArr)
+        for owner, ownerNotificationMap := range ownerMap {
+            var ownerResolvedArr []*findingStruct
+            for _, finding := range resolvedArr {
+                if _, ok := finding.OwnerMap[owner]; ok {
+                    ownerResolvedArr = append(ownerResolvedArr, finding)
+                }
+            }
+            ownerHeader := make(map[string]string)
+            for k, v := range mailHeader {
+                ownerHeader[k] = v
+            }
+            ownerHeader["To"] = owner
+            ownerHeader["Subject"] = *cliPtr.subject + ": your items"
+            // just their findings: the policy isn't theirs to see
+            sendMailFromTemplate(ownerHeader, nil, nil, ownerNotificationMap, ownerResolvedArr, owner, nil)
+            ownerCountMap[owner] = len(ownerNotificationMap)
+        }
+        logIt(nil, fmt.Sprintf("Mailed %d owners", len(ownerCountMap)), info)
+        if len(skippedArr) > 0 {
+            logIt(nil, fmt.Sprintf("Not mailing %d owners outside the policy's domains, whose items are only in this report: %s", 
+                len(skippedArr), strings.Join(skippedArr, ", ")), info)
+        }
+    }
+
+    mailHeader["To"] = *cliPtr.mailTo
+    mailHeader["Subject"] = *cliPtr.subject
+    logMutex.Lock()
+    reportLogArr := append([]string(nil), logArr...)
+    logMutex.Unlock()
+    sendMailFromTemplate(mailHeader, folderPolicyArr, reportLogArr, notificationMap, resolvedArr, "", ownerCountMap)
+}
+
+// Split the notifications by owner; an item with several owners goes to each of them, without the others or the permitted domains.
+// Owners outside the domains in the policy may be outside the organisation, so are returned sorted instead of mailed.
+// Shared drive items have no owners, so appear only in the mailTo report.
+func ownerNotifications(notificationMap map[string]*notificationStruct, folderPolicyArr []*folderPolicyStruct) (map[string]map[string]*notificationStruct, []string) {
+
+    var skippedArr []string
+
+    policyDomainMap := make(map[string]struct{})
+    for _, policy := range folderPolicyArr {
+        policyDomainMap[strings.ToLower(policy.Domain)] = struct{}{} // group addresses and public never match an owner's domain
+    }
+
+    ownerMap := make(map[string]map[string]*notificationStruct)
+    skippedMap := make(map[string]struct{})
+    for itemId, notification := range notificationMap {
+        for owner, displayName := range notification.OwnerMap {
+            if _, ok := policyDomainMap[strings.ToLower(owner[strings.LastIndex(owner, "@") + 1:])]; !ok {
+                skippedMap[owner] = struct{}{}
+                continue
+            }
+            if _, ok := ownerMap[owner]; !ok {
+                ownerMap[owner] = make(map[string]*notificationStruct)
+            }
+            ownerMap[owner][itemId] = &notificationStruct{
+                Name: notification.Name,
+                Url: notification.Url,
+                ItemType: notification.ItemType,
+                OwnerMap: map[string]string{owner: displayName},
+                PermissionMap: notification.PermissionMap,
+            }
+        }
+    }
+    for owner := range skippedMap {
+        skippedArr = append(skippedArr, owner)
+    }
+    sort.Strings(skippedArr)
+    return ownerMap, skippedArr
+}
+
+// Merge this run's out of policy shares into the findings, and mail them if a digest is due
+func reportFindings() {
+
+    var (
+        digest time.Duration
+        err error
+        now = time.Now()
+    )
+
+    if *cliPtr.digest != "" {
+        digest, err = time.ParseDuration(*cliPtr.digest)
+        if err != nil {
+            logIt(err, "Unable to parse --digest", fatal)
+        }
+    }
+
+    state, err := loadFindings(*cliPtr.findings)
+    if err != nil {
+        logIt(err, "Unable to load findings", fatal)
+    }
+    updateFindings(state, now)
+
+    if *cliPtr.mailTo != "" {
+        if now.Sub(state.LastMail) < digest {
+            logIt(nil, "Next digest due at " + state.LastMail.Add(digest).Format(time.RFC3339), info)
+        } else {
+            openMap, resolvedArr := digestFindings(state)
+            mailReport(openMap, resolvedArr)
+            // resolved shares have now been reported
+            for key, finding := range state.FindingMap {
+                if finding.Resolved != nil {
+                    delete(state.FindingMap, key)
+                }
+            }
+            state.LastMail = now
+        }
+    }
+
+    err = saveFindings(*cliPtr.findings, state)
+    if err != nil {
+        logIt(err, "Unable to save findings", warning)
+    }
+}
+
+// Record the shares found this run and resolve the open ones which weren't, among the items evaluated this run
+func updateFindings(state *findingsStateStruct, now time.Time) {
+
+    seenMap := make(map[string]struct{})
+    for itemId, notification := range notificationMap {
+        for grantee, permission := range notification.PermissionMap {
+            key := itemId + " " + grantee
+            seenMap[key] = struct{}{}
+            finding, ok := state.FindingMap[key]
+            if !ok || finding.Resolved != nil {
+                // new, or back after being resolved
+                finding = &findingStruct{ItemId: itemId, Grantee: grantee, FirstSeen: now}
+                state.FindingMap[key] = finding
+            }
+            finding.Name = notification.Name
+            finding.Url = notification.Url
+            finding.ItemType = notification.ItemType
+            finding.OwnerMap = notification.OwnerMap
+            finding.PermittedDomainMap = notification.PermittedDomainMap
+            finding.Role = permission.Role
+            finding.Response = permission.Response
+            finding.PermittedRole = permission.PermittedRole
+            finding.LastSeen = now
+            if permission.Response == "Success" {
+                finding.Resolved = &now // fixed by this run
+            }
+            permission.New = finding.FirstSeen.After(state.LastMail)
+        }
+    }
+
+    for key, finding := range state.FindingMap {
+        if _, seen := seenMap[key]; seen || finding.Resolved != nil {
+            continue
+        }
+        _, evaluated := itemWithPolicyMap[finding.ItemId]
+        // incremental runs only evaluate changed items; those dropped from the snapshot were deleted or moved out
+        _, inSnapshot := snapshotItemMap[finding.ItemId]
+        if evaluated || *cliPtr.incremental != "" && !inSnapshot {
+            finding.Resolved = &now
+        }
+    }
+}
+
+// Open shares by item, in the form the permissions template takes, and those resolved since the last mail
+func digestFindings(state *findingsStateStruct) (map[string]*notificationStruct, []*findingStruct) {
+
+    var resolvedArr []*findingStruct
+
+    openMap := make(map[string]*notificationStruct)
+    for _, finding := range state.FindingMap {
+        if finding.Resolved != nil && finding.Response != "Success" {
+            resolvedArr = append(resolvedArr, finding)
+            continue
+        }
+        // include shares fixed this run, struck through as in a regular mail
+        if _, ok := openMap[finding.ItemId]; !ok {
+            openMap[finding.ItemId] = &notificationStruct{
+                finding.Name,
+                finding.Url,
+                finding.ItemType,
+                finding.OwnerMap,
+                finding.PermittedDomainMap,
+                make(map[string]*permissionStruct),
+            }
+        }
+        openMap[finding.ItemId].PermissionMap[finding.Grantee] = &permissionStruct{
+            finding.Role,
+            finding.Response,
+            finding.PermittedRole,
+            finding.FirstSeen.After(state.LastMail),
+        }
+    }
+    sort.Slice(resolvedArr, func(i, j int) bool { return resolvedArr[i].Resolved.Before(*resolvedArr[j].Resolved) })
+    return openMap, resolvedArr
+}
+
+func loadFindings(findingsFile string) (*findingsStateStruct, error) {
+
+    state := &findingsStateStruct{FindingMap: make(map[string]*findingStruct)}
+    byt, err := ioutil.ReadFile(findingsFile)
+    if os.IsNotExist(err) {
+        return state, nil // first run
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(byt, state); err != nil {
+        return nil, fmt.Errorf("Unable to parse %s: %v", findingsFile, err)
+    }
+    if state.FindingMap == nil {
+        state.FindingMap = make(map[string]*findingStruct)
+    }
+    return state, nil
+}
+
+func saveFindings(findingsFile string, state *findingsStateStruct) error {
+
+    byt, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writePrivateFile(findingsFile, byt)
+}
+
+// Installed-app OAuth config, token cache and flow for the auth commands
+func authSetup() (*oauthcmd.Auth, error) {
+    if credentialPath == "" {
+        return nil, errors.New("the auth commands manage the cached user token; application default credentials have none")
+    }
+    byt, err := ioutil.ReadFile(credentialPath)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read client secret file: %v", err)
+    }
+    config, err := google.ConfigFromJSON(byt, scopeArr...)
+    if err != nil {
+        return nil, fmt.Errorf("unable to parse client secret file to config; service account keys have no cached token to manage: %v", err)
+    }
+    return &oauthcmd.Auth{Config: config, Store: tokenStore, Flow: authFlow}, nil
+}
+
+
+// List a folder's items and queue its subfolders, with the permitted domains they inherit
+func folderPermissions(folder *drive.File, permittedDomainMap map[string]string, queue *folderQueue) {
+       
+    var (
+        fileArr []*drive.File
+        nextPageToken  string = ""  
+        itemPermittedDomainMap map[string]string            
+    )
+
+    //get files in folder
+
+    // don't do initial file read concurrently with go routines or will exceed quota
+    // var wgFiles sync.WaitGroup // declare here so get new one for each recursion level
+    // moreFiles = true
+    for {
+        //wgFiles.Add(1)
+        //go func() {
+        qArr := []string{"'",folder.Id,"' in parents and trashed = false"}
+        qString := strings.Join(qArr,"")
+        throttle()
+        r, err := listFilesCall(folder, qString, nextPageToken).Do()
+                        // v3 PageSize(pageSize).Fields("nextPageToken, files(id, name, mimeType, webViewLink, owners, permissions)").Do()
+        // transient errors have already been retried by retryTransport
+        if err != nil {
+            logIt(err, "Unable to list files in folder " + folder.Id + "; ", warning)
+            /*mutex.Lock()
+            moreFiles = false
+            mutex.Unlock()*/
+            break
+        }
+        
+        //mutex.Lock()
+        fileArr = append(fileArr,r.Items...)
+        // v3 fileArr = append(fileArr,r.Files...)
+        //mutex.Unlock()
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            /*mutex.Lock()
+            moreFiles = false
+            mutex.Unlock()*/
+            break
+        }
+
+        //wgFiles.Done()
+        //}()
+    }
+    //wgFiles.Wait()
+    //}
+       
+    
+    for _, item := range fileArr {
+        if item.DriveId != "" {
+            // Files.List doesn't return permissions for shared drive items
+            permissionArr, err := listPermissions(item)
+            if err != nil {
+                logIt(err, "Unable to list permissions for item " + item.Id + "; ", warning)
+            }
+            item.Permissions = permissionArr
+        }
+    }
+
+    // hold the lock for every item, so domains another path passes down to the folder meanwhile reach either
+    // permittedDomainMap, before it's copied below, or the items recorded as the folder's
+    mutex.Lock()
+    defer mutex.Unlock()
+    visitedFolderMap[folder.Id].itemArr = fileArr
+    for _, item := range fileArr {
+
+        // set local tree of permitted domains for each item separately
+        // otherwise aggregate across items
+        itemPermittedDomainMap = make(map[string]string) 
+        for domain, role := range permittedDomainMap {
+           itemPermittedDomainMap[domain] = role
+        }
+
+        // add permitted domains for current folder
+        if item.MimeType == folderMimeType {
+            // need to do this before queueing it to avoid it pushing up the stack
+            for _, policy := range folderPolicyMap[item.Id] {
+                permitRole(itemPermittedDomainMap, policy.Domain, policy.Role)
+            }
+            // each subfolder gets its own copy of the map, so siblings don't aggregate each other's domains
+            queueFolder(queue, item, itemPermittedDomainMap)
+        }
+
+        // do this after have already incremented the permissions  
+        // and before call async goroutines which could change permittedDomainMap up the tree by reference           
+        //validatePermissions(item, permittedDomainMap) 
+        //validatePermissions(item, itemPermittedDomainMap) 
+        upsertItemDetail(item, itemPermittedDomainMap) 
+    }
+}
+
+// Queue a folder to list, with the domains it passes down; call with mutex held.
+// A folder already reached, from another root or another parent, isn't listed again:
+// the domains are passed down to the items found below it instead.
+func queueFolder(queue *folderQueue, folder *drive.File, permittedDomainMap map[string]string) {
+    if visited, ok := visitedFolderMap[folder.Id]; ok {
+        inheritDomains(visited, permittedDomainMap)
+        return
+    }
+    visitedFolderMap[folder.Id] = &visitedFolderStruct{permittedDomainMap: permittedDomainMap}
+    queue.push(&folderJobStruct{folder, permittedDomainMap})
+}
+
+// Permit the domains on a folder already reached, and pass any it didn't already permit down to the items below it
+func inheritDomains(visited *visitedFolderStruct, permittedDomainMap map[string]string) {
+    if !permitDomains(visited.permittedDomainMap, permittedDomainMap) {
+        return
+    }
+    for _, item := range visited.itemArr {
+        if subfolder, ok := visitedFolderMap[item.Id]; ok && item.MimeType == folderMimeType {
+            // shares its map with the subfolder's item
+            inheritDomains(subfolder, visited.permittedDomainMap)
+        } else {
+            upsertItemDetail(item, visited.permittedDomainMap)
+        }
+    }
+}
+
+// Permit each of the domains, returning whether any wasn't already permitted with at least that role
+func permitDomains(permittedDomainMap map[string]string, addedDomainMap map[string]string) bool {
+    added := false
+    for domain, role := range addedDomainMap {
+        existingRole, ok := permittedDomainMap[domain]
+        permitRole(permittedDomainMap, domain, role)
+        added = added || !ok || permittedDomainMap[domain] != existingRole
+    }
+    return added
+}
+
+// List the folders and everything below them with a fixed number of workers, rather than a goroutine per folder.
+// With a checkpoint, list the folders it had still to list instead.
+func walkFolders(jobArr []*folderJobStruct, pageToken string, checkpoint *checkpointStruct) {
+
+    var (
+        wgWorkers sync.WaitGroup
+        wgCheckpoint sync.WaitGroup
+        stopCheckpoint = make(chan struct{})
+    )
+
+    queue := newFolderQueue()
+    visitedFolderMap = make(map[string]*visitedFolderStruct)
+    mutex.Lock()
+    if checkpoint == nil {
+        for _, job := range jobArr {
+            queueFolder(queue, job.folder, job.permittedDomainMap)
+        }
+    } else {
+        for _, entry := range checkpoint.ItemArr {
+            itemWithPolicyMap[entry.Item.Id] = &itemWithPolicyStruct{entry.Item, entry.PermittedDomainMap}
+            if entry.Item.MimeType == folderMimeType {
+                visitedFolderMap[entry.Item.Id] = &visitedFolderStruct{permittedDomainMap: entry.PermittedDomainMap}
+            }
+        }
+        // the folders found have been listed, unless they're queued again below
+        for _, entry := range checkpoint.ItemArr {
+            for _, parent := range entry.Item.Parents {
+                if visited, ok := visitedFolderMap[parent.Id]; ok {
+                    visited.itemArr = append(visited.itemArr, entry.Item)
+                }
+            }
+        }
+        for _, entry := range checkpoint.FolderArr {
+            permittedDomainMap := entry.PermittedDomainMap
+            if visited, ok := visitedFolderMap[entry.Item.Id]; ok {
+                // share the map with the folder's item again
+                permitDomains(visited.permittedDomainMap, permittedDomainMap)
+                permittedDomainMap = visited.permittedDomainMap
+                visited.itemArr = nil
+            } else {
+                visitedFolderMap[entry.Item.Id] = &visitedFolderStruct{permittedDomainMap: permittedDomainMap}
+            }
+            queue.push(&folderJobStruct{entry.Item, permittedDomainMap})
+        }
+        logIt(nil, fmt.Sprintf("Resuming from checkpoint: %d items found, %d folders to list", len(checkpoint.ItemArr), len(checkpoint.FolderArr)), info)
+    }
+    mutex.Unlock()
+
+    if *cliPtr.checkpoint != "" {
+        policyHash := hashPolicy()
+        wgCheckpoint.Add(1)
+        go func() {
+            defer wgCheckpoint.Done()
+            ticker := time.NewTicker(checkpointInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-stopCheckpoint:
+                    return
+                case <-ticker.C:
+                    err := writeCheckpoint(queue, policyHash, pageToken)
+                    if err != nil {
+                        logIt(err, "Unable to write checkpoint", warning)
+                    }
+                }
+            }
+        }()
+    }
+
+    for i := 0; i < *cliPtr.workers; i++ {
+        wgWorkers.Add(1)
+        go func() {
+            defer wgWorkers.Done()
+            for {
+                job, ok := queue.pop()
+                if !ok {
+                    return
+                }
+                folderPermissions(job.folder, job.permittedDomainMap, queue)
+                queue.done(job)
+            }
+        }()
+    }
+    wgWorkers.Wait()
+
+    if *cliPtr.checkpoint != "" {
+        // wait for any checkpoint being written, so it doesn't outlive the scan
+        close(stopCheckpoint)
+        wgCheckpoint.Wait()
+        err := os.Remove(*cliPtr.checkpoint)
+        if err != nil && !os.IsNotExist(err) {
+            logIt(err, "Unable to delete checkpoint", warning)
+        }
+    }
+}
+
+// A folder to list, with the permitted domains it inherits
+type folderJobStruct struct {
+    folder *drive.File
+    permittedDomainMap map[string]string
+}
+
+// A folder the walk has reached: the domains it passes down and, once listed, its items
+type visitedFolderStruct struct {
+    permittedDomainMap map[string]string
+    itemArr []*drive.File
+}
+
+// Folders waiting to be listed. Unbounded, since the workers queue the subfolders they find
+// and would deadlock if they blocked on a full channel.
+type folderQueue struct {
+    mutex sync.Mutex
+    cond *sync.Cond
+    jobArr []*folderJobStruct
+    activeMap map[*folderJobStruct]struct{} // being listed, for checkpoints
+    pending int // queued or being listed; the walk is over when none are
+}
+
+func newFolderQueue() *folderQueue {
+    queue := &folderQueue{activeMap: make(map[*folderJobStruct]struct{})}
+    queue.cond = sync.NewCond(&queue.mutex)
+    return queue
+}
+
+func (queue *folderQueue) push(job *folderJobStruct) {
+    queue.mutex.Lock()
+    queue.jobArr = append(queue.jobArr, job)
+    queue.pending++
+    queue.mutex.Unlock()
+    queue.cond.Signal()
+}
+
+// Waits for a folder, or returns false once every folder has been listed
+func (queue *folderQueue) pop() (*folderJobStruct, bool) {
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+    for len(queue.jobArr) == 0 && queue.pending > 0 {
+        queue.cond.Wait()
+    }
+    if len(queue.jobArr) == 0 {
+        return nil, false
+    }
+    job := queue.jobArr[0]
+    queue.jobArr[0] = nil
+    queue.jobArr = queue.jobArr[1:]
+    queue.activeMap[job] = struct{}{}
+    return job, true
+}
+
+// Marks a popped folder as listed, after its subfolders have been pushed
+func (queue *folderQueue) done(job *folderJobStruct) {
+    queue.mutex.Lock()
+    delete(queue.activeMap, job)
+    queue.pending--
+    if queue.pending == 0 {
+        queue.cond.Broadcast() // release the idle workers
+    }
+    queue.mutex.Unlock()
+}
+
+// Token bucket: tokens accrue at the quota rate up to a burst, and each Drive query takes one
+type rateLimiter struct {
+    mutex sync.Mutex
+    rate float64 // tokens per second
+    burst float64
+    tokens float64 // negative when queries are waiting for tokens
+    last time.Time
+}
+
+func newRateLimiter(queriesPer100s int) *rateLimiter {
+    rate := float64(queriesPer100s) / 100
+    // a small burst, so a full bucket can't exceed the quota within any 100 seconds by much
+    burst := rate
+    if burst < 1 {
+        burst = 1
+    }
+    return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Blocks until a token is available. Takes it in advance, so concurrent callers queue up behind each other.
+func (limiter *rateLimiter) wait() {
+    limiter.mutex.Lock()
+    now := time.Now()
+    limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+    if limiter.tokens > limiter.burst {
+        limiter.tokens = limiter.burst
+    }
+    limiter.last = now
+    limiter.tokens--
+    delay := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+    limiter.mutex.Unlock()
+    if delay > 0 {
+        time.Sleep(delay)
+    }
+}
+
+// Count a Drive query, and wait for the quota to allow it
+func throttle() {
+    atomic.AddUint64(&apiCallCount, 1)
+    if limiter != nil {
+        limiter.wait()
+    }
+}
+
+// Files in folder, including those in shared drives
+func listFilesCall(folder *drive.File, qString string, nextPageToken string) *drive.FilesListCall {
+    call := driveService.Files.List().Q(qString).PageToken(nextPageToken).
+                MaxResults(pageSize).SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+                Fields("nextPageToken, items(" + itemFields + ")")
+    if folder.DriveId != "" {
+        call = call.Corpora("drive").DriveId(folder.DriveId)
+    }
+    return call
+}
+
+func listPermissions(item *drive.File) ([]*drive.Permission, error) {
+
+    var (
+        permissionArr []*drive.Permission
+        nextPageToken string = ""
+    )
+
+    for {
+        throttle()
+        r, err := driveService.Permissions.List(item.Id).SupportsAllDrives(true).PageToken(nextPageToken).Do()
+        if err != nil {
+            return nil, err
+        }
+        permissionArr = append(permissionArr, r.Items...)
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            break
+        }
+    }
+    return permissionArr, nil
+}
+
+// The top-level folder of a shared drive has the drive's id
+func isSharedDrive(item *drive.File) bool {
+    return item.DriveId != "" && item.Id == item.DriveId
+}
+
+// Shared drive items carry their drive's members and their ancestors' permissions as inherited permissions;
+// these are validated on the drive or folder which grants them, and can't be deleted from the item itself.
+// My Drive permissions have no details.
+func isInherited(permission *drive.Permission) bool {
+    if len(permission.PermissionDetails) == 0 {
+        return false
+    }
+    for _, detail := range permission.PermissionDetails {
+        if !detail.Inherited {
+            return false
+        }
+    }
+    return true
+}
+
+// Accumulate prior to validation since a file/folder with multiple parents 
+// may have valid permittedDomains on one of the parent's ancestors which then apply to the file/folder
+// even though it doesn't have them on the other parent's ancestors.
+func upsertItemDetail(item *drive.File, permittedDomainMap map[string]string) {
+
+    var (      
+        id string = item.Id  
+    )
 
     _, itemWithPolicyMapExists := itemWithPolicyMap[id]
     if !itemWithPolicyMapExists {
         itemWithPolicyMap[id] = &itemWithPolicyStruct{item, permittedDomainMap}   
     } else {
-        for domain, _ := range permittedDomainMap {
-            itemWithPolicyMap[id].permittedDomainMap[domain] = struct{}{}
+        for domain, role := range permittedDomainMap {
+            permitRole(itemWithPolicyMap[id].permittedDomainMap, domain, role)
         } 
     }  
 
 }
 
-func validatePermissions(itemWithPolicyMapLocal map[string]*itemWithPolicyStruct) {
+func validatePermissions(itemWithPolicyMapLocal map[string]*itemWithPolicyStruct) {
+
+    var ( 
+        isFolder bool
+        domainMatch bool
+        exceedsRole bool
+        permittedRole string
+        item *drive.File
+        itemType string        
+        ownerMap map[string]string
+        permissionMap map[string]*permissionStruct
+        permittedDomainMap map[string]string
+        emailAddress string
+        emailAddressArr []string
+        domain string
+        // permissionMap = make(map[string]string)
+        response string
+        )
+
+    for itemId, itemWithPolicy := range itemWithPolicyMapLocal {
+
+        item = itemWithPolicy.item
+        ownerMap = make(map[string]string)
+        permittedDomainMap = itemWithPolicy.permittedDomainMap
+        permissionMap = make(map[string]*permissionStruct)
+
+        for _, permission := range item.Permissions {
+
+            if permission.Deleted != true && !isInherited(permission) {
+
+                if isSharedDrive(item) {
+                    isFolder = true
+                    itemType = "Shared drive"
+                } else if item.MimeType == folderMimeType {
+                    isFolder = true
+                    itemType = "Folder"
+                } else {
+                    isFolder = false
+                    itemType = "File"
+                }
+                
+                if permission.Type == "domain" {                  
+                    domain = permission.Domain
+                } else {
+                    // v3 Drive API doesn't include domain in the permissions returned by File list unless the file is domain-shared
+                    // More performant to parse the email address than to get the permission
+                    emailAddressArr = strings.Split(permission.EmailAddress,"@")
+                    if len(emailAddressArr) < 2  {     
+                        domain = ""
+                        logIt(nil, "Unable to get domain from permission email for itemId: " + itemId + "; type: " + permission.Type + "; emailAddress: " + permission.EmailAddress, warning)
+                    } else {
+                        domain = emailAddressArr[1]
+                    }
+                }
+                permittedRole, domainMatch = policyRole(permission, domain, permittedDomainMap)
+                exceedsRole = domainMatch && roleExceeds(permission, permittedRole)
+                if !exceedsRole {
+                    permittedRole = ""
+                }
+
+                if (!domainMatch || exceedsRole) &&
+                    (*cliPtr.itemType == "both" || 
+                    (*cliPtr.itemType == "folder" && isFolder || *cliPtr.itemType == "file" && !isFolder))  {
+                    
+                    switch permission.Type {
+                    case "user":
+                        emailAddress = permission.EmailAddress
+                    case "group":
+                        emailAddress = permission.EmailAddress
+                    case "domain":
+                        emailAddress = permission.Domain
+                    case "anyone":
+                        emailAddress = permission.Id
+                    default:
+                        emailAddress = permission.Type
+                    }
+
+                    if *cliPtr.fix && exceedsRole {
+                        response = downgradePermission(item, itemType, permission, emailAddress, permittedRole)
+                    } else if *cliPtr.fix {
+                        response = fixPermission(item, itemType, permission, emailAddress)
+                    } else {
+                        response = ""
+                    }
+                    if remediationPlan != nil {
+                        remediationPlan.Entries = append(remediationPlan.Entries, newPlanEntry(item, itemType, permission, emailAddress, permittedRole))
+                    }
+                    if *cliPtr.mailTo != "" || *cliPtr.findings != "" || *cliPtr.resultsSheet != "" {
+
+                        _, notificationMapExists := notificationMap[itemId]
+
+                        if notificationMapExists {  
+                            notificationMap[itemId].PermissionMap[emailAddress] = &permissionStruct{permissionRole(permission), response, permittedRole, false}
+                        } else {
+                             
+                            for _, owner := range item.Owners {
+                                ownerMap[owner.EmailAddress] = owner.DisplayName
+                            }
+
+                            permissionMap[emailAddress] = &permissionStruct{permissionRole(permission), response, permittedRole, false}
+                            
+                            notificationMap[itemId] = &notificationStruct{   
+                                                    item.Title,                                                              
+                                                    // v3 item.Name,    
+                                                    item.AlternateLink,                                          
+                                                    // v3 item.WebViewLink, 
+                                                    itemType, 
+                                                    ownerMap,
+                                                    permittedDomainMap,
+                                                    permissionMap,
+                                                }
+                        }
+                        
+                    }
+                }                   
+            }
+        }
+    }
+}
+
+func fixPermission(item *drive.File, itemType string, permission *drive.Permission, emailAddress string) string {
+
+  // record before deleting so there's no change without a way back
+  err := writeJournal(deleteAction, item, itemType, permission)
+  if err != nil {
+    logIt(err, "Unable to write journal; not deleting permission " + emailAddress + " from " + item.Id, warning)
+    return "Failure"
+  }
+  service, err := itemDriveService(item.Id)
+  if err != nil {
+    logIt(err, "Unable to impersonate the owner of " + item.Id + "; not deleting permission " + emailAddress, warning)
+    return "Failure"
+  }
+  // removes the member if item is a shared drive
+  throttle()
+  err = service.Permissions.Delete(item.Id, permission.Id).SupportsAllDrives(true).Do()
+  if err != nil {
+    logIt(err, fmt.Sprintf("Unable to delete permission %s: %s from %s %s (%s)", 
+        emailAddress, 
+        permission.Role,
+        itemType, 
+        item.Title,       
+        // v3 item.Name, 
+        item.Id),
+        warning)
+    return "Failure"
+  }
+  return "Success"
+}
+
+
+// Downgrade rather than delete shares which the policy permits with a lesser role
+func downgradePermission(item *drive.File, itemType string, permission *drive.Permission, emailAddress string, role string) string {
+
+  downgraded := &drive.Permission{Role: role, Type: permission.Type}
+  if role == "commenter" {
+    downgraded.Role = "reader"
+    downgraded.AdditionalRoles = []string{"commenter"}
+  }
+  err := writeJournal(downgradeAction, item, itemType, permission)
+  if err != nil {
+    logIt(err, "Unable to write journal; not downgrading permission " + emailAddress + " on " + item.Id, warning)
+    return "Failure"
+  }
+  service, err := itemDriveService(item.Id)
+  if err != nil {
+    logIt(err, "Unable to impersonate the owner of " + item.Id + "; not downgrading permission " + emailAddress, warning)
+    return "Failure"
+  }
+  throttle()
+  _, err = service.Permissions.Update(item.Id, permission.Id, downgraded).SupportsAllDrives(true).Do()
+  if err != nil {
+    logIt(err, fmt.Sprintf("Unable to downgrade permission %s: %s to %s on %s %s (%s)", 
+        emailAddress, 
+        permissionRole(permission),
+        role,
+        itemType, 
+        item.Title,       
+        item.Id),
+        warning)
+    return "Failure"
+  }
+  return "Success"
+}
+
+// Append one line per change; the file is never rewritten, so entries keep their numbers for restore
+func writeJournal(action string, item *drive.File, itemType string, permission *drive.Permission) error {
+
+    byt, err := json.Marshal(&journalEntryStruct{
+        Time: time.Now(),
+        Action: action,
+        ItemId: item.Id,
+        ItemTitle: item.Title,
+        ItemType: itemType,
+        Permission: permission,
+        Owner: itemOwnerMap[item.Id],
+    })
+    if err != nil {
+        return err
+    }
+
+    journalMutex.Lock()
+    defer journalMutex.Unlock()
+    file, err := os.OpenFile(*cliPtr.journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(append(byt, '\n')); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+func readJournal(journalFile string) ([]*journalEntryStruct, error) {
+
+    var entryArr []*journalEntryStruct
+
+    byt, err := ioutil.ReadFile(journalFile)
+    if err != nil {
+        return nil, err
+    }
+    for index, line := range strings.Split(string(byt), "\n") {
+        entry := &journalEntryStruct{}
+        if strings.TrimSpace(line) != "" {
+            if err := json.Unmarshal([]byte(line), entry); err != nil {
+                return nil, fmt.Errorf("Journal %s line %d: %v", journalFile, index + 1, err)
+            }
+        } else {
+            entry = nil // keep numbering by line
+        }
+        entryArr = append(entryArr, entry)
+    }
+    return entryArr, nil
+}
+
+func (entry *journalEntryStruct) String() string {
+    target := entry.Permission.EmailAddress
+    if target == "" {
+        target = entry.Permission.Domain
+    }
+    if target == "" {
+        target = entry.Permission.Type
+    }
+    return fmt.Sprintf("%s %s %s: %s on %s %s (%s)", entry.Time.Format(time.RFC3339), entry.Action, target, permissionRole(entry.Permission), entry.ItemType, entry.ItemTitle, entry.ItemId)
+}
+
+// Re-create deleted permissions and return downgraded ones to their original role
+func restoreJournal(entryNumArr []int, since time.Time, itemIdArr []string, list bool, notify bool) {
+
+    var (
+        selected bool
+        restored, failed int
+    )
+
+    entryArr, err := readJournal(*cliPtr.journal)
+    if err != nil {
+        log.Fatalf("Unable to read journal: %v", err)
+    }
+
+    selectedMap := make(map[int]struct{})
+    for _, entryNum := range entryNumArr {
+        if entryNum < 1 || entryNum > len(entryArr) || entryArr[entryNum - 1] == nil {
+            log.Fatalf("No journal entry %d", entryNum)
+        }
+        selectedMap[entryNum] = struct{}{}
+    }
+    itemIdMap := make(map[string]struct{})
+    for _, itemId := range itemIdArr {
+        itemIdMap[itemId] = struct{}{}
+    }
+
+    if list {
+        for index, entry := range entryArr {
+            if entry != nil {
+                fmt.Printf("%d\t%s\n", index + 1, entry)
+            }
+        }
+        return
+    }
+    if len(selectedMap) == 0 && since.IsZero() && len(itemIdMap) == 0 {
+        log.Fatalf("Please select entries to restore by number, --since or --item; use --list to see them")
+    }
+
+    scopeArr = append(scopeArr, driveScope)
+    client := setupClient()
+    driveService, err = drive.New(client)
+    if err != nil {
+        logIt(err, "Unable to create Drive client", fatal)
+    }
+
+    for index, entry := range entryArr {
+        if entry == nil {
+            continue
+        }
+        _, selected = selectedMap[index + 1]
+        if !selected && !since.IsZero() {
+            selected = !entry.Time.Before(since)
+        }
+        if _, ok := itemIdMap[entry.ItemId]; ok {
+            selected = true
+        }
+        if !selected {
+            continue
+        }
+
+        service, err := ownerDriveService(entry.Owner)
+        if err != nil {
+            logIt(err, fmt.Sprintf("Unable to impersonate %s to restore journal entry %d: %s", entry.Owner, index + 1, entry), warning)
+            failed++
+            continue
+        }
+        throttle()
+        if entry.Action == downgradeAction {
+            original := &drive.Permission{Role: entry.Permission.Role, AdditionalRoles: entry.Permission.AdditionalRoles, Type: entry.Permission.Type}
+            _, err = service.Permissions.Update(entry.ItemId, entry.Permission.Id, original).SupportsAllDrives(true).Do()
+        } else {
+            value := entry.Permission.EmailAddress
+            if entry.Permission.Type == "domain" {
+                value = entry.Permission.Domain
+            }
+            recreated := &drive.Permission{
+                Type: entry.Permission.Type,
+                Role: entry.Permission.Role,
+                AdditionalRoles: entry.Permission.AdditionalRoles,
+                Value: value,
+                WithLink: entry.Permission.WithLink,
+                ExpirationDate: entry.Permission.ExpirationDate,
+            }
+            _, err = service.Permissions.Insert(entry.ItemId, recreated).
+                        SendNotificationEmails(notify).SupportsAllDrives(true).Do()
+        }
+        if err != nil {
+            logIt(err, fmt.Sprintf("Unable to restore journal entry %d: %s", index + 1, entry), warning)
+            failed++
+        } else {
+            logIt(nil, fmt.Sprintf("Restored journal entry %d: %s", index + 1, entry), info)
+            restored++
+        }
+    }
+
+    logIt(nil, fmt.Sprintf("Journal %s: restored %d, failed %d", *cliPtr.journal, restored, failed), info)
+    logService.Close()
+}
+
+func newPlanEntry(item *drive.File, itemType string, permission *drive.Permission, emailAddress string, permittedRole string) *planEntryStruct {
+
+    entry := &planEntryStruct{
+        ItemId: item.Id,
+        ItemTitle: item.Title,
+        ItemType: itemType,
+        PermissionId: permission.Id,
+        Type: permission.Type,
+        EmailAddress: permission.EmailAddress,
+        Domain: permission.Domain,
+        Role: permissionRole(permission),
+        Action: deleteAction,
+        Reason: fmt.Sprintf("%s %s not permitted by policy", permission.Type, emailAddress),
+        Owner: itemOwnerMap[item.Id],
+    }
+    if permittedRole != "" {
+        entry.Action = downgradeAction
+        entry.PermittedRole = permittedRole
+        entry.Reason = fmt.Sprintf("role %s exceeds the permitted maximum %s", entry.Role, permittedRole)
+    }
+    return entry
+}
+
+func (entry *planEntryStruct) target() string {
+    if entry.EmailAddress != "" {
+        return entry.EmailAddress
+    }
+    if entry.Domain != "" {
+        return entry.Domain
+    }
+    return entry.Type
+}
+
+// Why the permission no longer matches the plan; empty if it still does
+func (entry *planEntryStruct) changed(permission *drive.Permission) string {
+    switch {
+    case permission.Type != entry.Type || permission.EmailAddress != entry.EmailAddress || permission.Domain != entry.Domain:
+        return "the permission id now refers to a different grantee"
+    case permissionRole(permission) != entry.Role:
+        return "role changed from " + entry.Role + " to " + permissionRole(permission)
+    case isInherited(permission):
+        return "the permission is now inherited"
+    }
+    return ""
+}
+
+func writePlan(planFile string, plan *planStruct) {
 
-    var ( 
-        public bool
-        isFolder bool
-        domainMatch bool
-        item *drive.File
-        itemType string        
-        ownerMap map[string]string
-        permissionMap map[string]*permissionStruct
-        permittedDomainMap map[string]struct{}
-        emailAddress string
-        emailAddressArr []string
-        domain string
-        // permissionMap = make(map[string]string)
-        response string
-        )
+    byt, err := json.MarshalIndent(plan, "", "  ")
+    if err != nil {
+        logIt(err, "Unable to encode plan", fatal)
+    }
+    err = writePrivateFile(planFile, byt)
+    if err != nil {
+        logIt(err, "Unable to write plan", fatal)
+    }
+    log.Printf("Wrote %d planned changes to %s; review, then run apply %s\n", len(plan.Entries), planFile, planFile)
+}
 
-    for itemId, itemWithPolicy := range itemWithPolicyMapLocal {
+// Execute exactly the plan: each entry is checked against the permission's current state first
+func applyPlan(planFile string) {
 
-        item = itemWithPolicy.item
-        ownerMap = make(map[string]string)
-        permittedDomainMap = itemWithPolicy.permittedDomainMap
-        permissionMap = make(map[string]*permissionStruct)
+    var (
+        plan planStruct
+        response string
+        applied, skipped, failed int
+    )
 
-        _, public = permittedDomainMap["public"]
+    byt, err := ioutil.ReadFile(planFile)
+    if err != nil {
+        log.Fatalf("Unable to read plan: %v", err)
+    }
+    if err := json.Unmarshal(byt, &plan); err != nil {
+        log.Fatalf("Unable to parse plan %s: %v", planFile, err)
+    }
 
-        for _, permission := range item.Permissions {
+    scopeArr = append(scopeArr, driveScope)
+    client := setupClient()
+    driveService, err = drive.New(client)
+    if err != nil {
+        logIt(err, "Unable to create Drive client", fatal)
+    }
 
-            if permission.Deleted != true {
+    for _, entry := range plan.Entries {
+        item := &drive.File{Id: entry.ItemId, Title: entry.ItemTitle}
+        description := fmt.Sprintf("%s %s: %s on %s %s (%s)", entry.Action, entry.target(), entry.Role, entry.ItemType, entry.ItemTitle, entry.ItemId)
 
-                if item.MimeType == folderMimeType {
-                    isFolder = true
-                    itemType = "Folder"
-                } else {
-                    isFolder = false
-                    itemType = "File"
-                }
-                
-                if permission.Type == "domain" {                  
-                    domain = permission.Domain
-                } else {
-                    // v3 Drive API doesn't include domain in the permissions returned by File list unless the file is domain-shared
-                    // More performant to parse the email address than to get the permission
-                    emailAddressArr = strings.Split(permission.EmailAddress,"@")
-                    if len(emailAddressArr) < 2  {     
-                        domain = ""
-                        logIt(nil, "Unable to get domain from permission email for itemId: " + itemId + "; type: " + permission.Type + "; emailAddress: " + permission.EmailAddress, warning)
-                    } else {
-                        domain = emailAddressArr[1]
-                    }
-                }
-                _, domainMatch = permittedDomainMap[domain]
-                
+        // fix and downgrade change it as the same user
+        itemOwnerMap[entry.ItemId] = entry.Owner
+        service, err := ownerDriveService(entry.Owner)
+        if err != nil {
+            logIt(err, "Skipping " + description + ": unable to impersonate " + entry.Owner, warning)
+            failed++
+            continue
+        }
+        throttle()
+        permission, err := service.Permissions.Get(entry.ItemId, entry.PermissionId).SupportsAllDrives(true).Do()
+        if err != nil {
+            logIt(err, "Skipping " + description + ": unable to get permission, it may have been removed", warning)
+            skipped++
+            continue
+        }
+        if reason := entry.changed(permission); reason != "" {
+            logIt(nil, "Skipping " + description + ": " + reason + " since the plan was made", warning)
+            skipped++
+            continue
+        }
 
-                if !domainMatch && !public &&
-                    (*cliPtr.itemType == "both" || 
-                    (*cliPtr.itemType == "folder" && isFolder || *cliPtr.itemType == "file" && !isFolder))  {
-                    
-                    switch permission.Type {
-                    case "user":
-                        emailAddress = permission.EmailAddress
-                    case "group":
-                        emailAddress = permission.EmailAddress
-                    case "domain":
-                        emailAddress = permission.Domain
-                    case "anyone":
-                        emailAddress = permission.Id
-                    default:
-                        emailAddress = permission.Type
-                    }
+        if entry.Action == downgradeAction {
+            response = downgradePermission(item, entry.ItemType, permission, entry.target(), entry.PermittedRole)
+        } else {
+            response = fixPermission(item, entry.ItemType, permission, entry.target())
+        }
+        if response == "Success" {
+            logIt(nil, "Applied " + description, info)
+            applied++
+        } else {
+            failed++
+        }
+    }
 
-                    if *cliPtr.fix {
-                        response = fixPermission(item, itemType, permission, emailAddress)
-                    } else {
-                        response = ""
-                    }
-                    if *cliPtr.mailTo != "" {
+    logIt(nil, fmt.Sprintf("Plan %s: applied %d, skipped %d, failed %d", planFile, applied, skipped, failed), info)
+    logService.Close()
+}
 
-                        _, notificationMapExists := notificationMap[itemId]
+// Append a row per out of policy share to the tab, adding the tab and its header row if absent
+func writeResults(spreadsheetId string, tab string) error {
 
-                        if notificationMapExists {  
-                            notificationMap[itemId].PermissionMap[permission.EmailAddress] = &permissionStruct{permission.Role, response}
-                        } else {
-                             
-                            for _, owner := range item.Owners {
-                                ownerMap[owner.EmailAddress] = owner.DisplayName
-                            }
+    var rowArr [][]interface{}
 
-                            permissionMap[emailAddress] = &permissionStruct{permission.Role, response}
-                            
-                            notificationMap[itemId] = &notificationStruct{   
-                                                    item.Title,                                                              
-                                                    // v3 item.Name,    
-                                                    item.AlternateLink,                                          
-                                                    // v3 item.WebViewLink, 
-                                                    itemType, 
-                                                    ownerMap,
-                                                    permittedDomainMap,
-                                                    permissionMap,
-                                                }
-                        }
-                        
-                    }
-                }                   
-            }
+    spreadsheet, err := sheetsService.Spreadsheets.Get(spreadsheetId).Fields("sheets.properties.title").Do()
+    if err != nil {
+        return err
+    }
+    tabExists := false
+    for _, sheet := range spreadsheet.Sheets {
+        if sheet.Properties.Title == tab {
+            tabExists = true
+        }
+    }
+    if !tabExists {
+        request := &sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{{AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: tab}}}}}
+        _, err = sheetsService.Spreadsheets.BatchUpdate(spreadsheetId, request).Do()
+        if err != nil {
+            return err
         }
     }
-}
 
-func fixPermission(item *drive.File, itemType string, permission *drive.Permission, emailAddress string) string {
+    // quote the tab name, which may contain spaces
+    tabRange := "'" + strings.Replace(tab, "'", "''", -1) + "'!A:J"
+    headerRange := "'" + strings.Replace(tab, "'", "''", -1) + "'!A1:J1"
+    headerResp, err := sheetsService.Spreadsheets.Values.Get(spreadsheetId, headerRange).Do()
+    if err != nil {
+        return err
+    }
+    for itemId, notification := range notificationMap {
+        var ownerArr, domainArr []string
+        for owner := range notification.OwnerMap {
+            ownerArr = append(ownerArr, owner)
+        }
+        for domain, role := range notification.PermittedDomainMap {
+            if role != "" {
+                domain += " (" + role + ")"
+            }
+            domainArr = append(domainArr, domain)
+        }
+        sort.Strings(ownerArr)
+        sort.Strings(domainArr)
+        for grantee, permission := range notification.PermissionMap {
+            fixResult := permission.Response
+            if fixResult == "" {
+                fixResult = "Not fixed"
+            }
+            rowArr = append(rowArr, []interface{}{
+                runId,
+                itemId,
+                notification.Name,
+                notification.ItemType,
+                strings.Join(ownerArr, ", "),
+                grantee,
+                permission.Role,
+                permission.PermittedRole,
+                strings.Join(domainArr, ", "),
+                fixResult,
+            })
+        }
+    }
+    if len(rowArr) == 0 {
+        return nil
+    }
+    rowCount := len(rowArr)
+    if len(headerResp.Values) == 0 {
+        rowArr = append([][]interface{}{resultsHeaderArr}, rowArr...)
+    }
 
-  err := driveService.Permissions.Delete(item.Id, permission.Id).Do()
-  if err != nil {
-    logIt(err, fmt.Sprintf("Unable to delete permission %s: %s from %s %s (%s)", 
-        emailAddress, 
-        permission.Role,
-        itemType, 
-        item.Title,       
-        // v3 item.Name, 
-        item.Id),
-        warning)
-    return "Failure"
-  }
-  return "Success"
+    // RAW so values such as ids aren't reinterpreted as numbers or dates
+    _, err = sheetsService.Spreadsheets.Values.Append(spreadsheetId, tabRange, &sheets.ValueRange{Values: rowArr}).ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Do()
+    if err == nil {
+        logIt(nil, fmt.Sprintf("Appended %d rows to results sheet for run %s", rowCount, runId), info)
+    }
+    return err
 }
 
-
 func getSheetData(sheetsService *sheets.Service, spreadsheetId string, readRange string) ([][]interface{}, error) {
 
     resp, err := sheetsService.Spreadsheets.Values.Get(spreadsheetId, readRange).Do()
@@ -612,26 +2634,297 @@ func getSheetData(sheetsService *sheets.Service, spreadsheetId string, readRange
     }      
 }
 
-func getPolicyArr(sheetRespValues [][]interface{}) []*folderPolicyStruct {
+// Rows of folder id, domain and optional maximum role, after a header row
+func getPolicyArr(rowArr [][]string) ([]*folderPolicyStruct, error) {
     var (
-        id string
-        domain string
+        role string
         policyArr []*folderPolicyStruct
         )
     
-    for index, row := range sheetRespValues {
+    for index, row := range rowArr {
         if index > 0 { // skip header
-            id = row[0].(string)
-            domain = row[1].(string)
-            policyArr = append(policyArr,
-                &folderPolicyStruct{
-                    id, 
-                    "",  //name
-                    domain})
+            if len(row) < 2 {
+                return nil, fmt.Errorf("Policy row %d: specify a folder id and domain", index + 1)
+            }
+            role = ""
+            if len(row) > 2 { // Sheets omits empty trailing cells
+                role = row[2]
+            }
+            policyArr = append(policyArr, &folderPolicyStruct{row[0], "", row[1], role})
+        }
+    }
+
+    return checkPolicyArr(policyArr)
+}
+
+// Normalize and validate the policy, whichever source it came from
+func checkPolicyArr(policyArr []*folderPolicyStruct) ([]*folderPolicyStruct, error) {
+
+    if len(policyArr) == 0 {
+        return nil, errors.New("No policy found")
+    }
+    for _, policy := range policyArr {
+        policy.Id = strings.TrimSpace(policy.Id)
+        policy.Domain = strings.TrimSpace(policy.Domain)
+        policy.Role = strings.TrimSpace(policy.Role)
+        if policy.Id == "" || policy.Domain == "" {
+            return nil, fmt.Errorf("Policy for folder %q, domain %q: specify both", policy.Id, policy.Domain)
+        }
+        if isGroup(policy.Domain) {
+            // Drive returns group email addresses in lower case
+            policy.Domain = strings.ToLower(policy.Domain)
+        }
+        if _, ok := roleRankMap[policy.Role]; !ok && policy.Role != "" || policy.Role == "owner" {
+            return nil, fmt.Errorf("Invalid maximum role %s for %s on folder %s; use reader, commenter, writer, fileOrganizer or organizer", policy.Role, policy.Domain, policy.Id)
+        }
+    }
+    return policyArr, nil
+}
+
+// --policyFile by extension, otherwise the spreadsheet
+func newPolicySource(client *http.Client) (PolicySource, error) {
+
+    var err error
+
+    if *cliPtr.policyFile != "" {
+        switch strings.ToLower(filepath.Ext(*cliPtr.policyFile)) {
+        case ".yaml", ".yml":
+            return &yamlPolicySource{*cliPtr.policyFile}, nil
+        case ".json":
+            return &jsonPolicySource{*cliPtr.policyFile}, nil
+        case ".csv":
+            return &csvPolicySource{*cliPtr.policyFile}, nil
+        default:
+            return nil, errors.New("Unsupported policy file type " + *cliPtr.policyFile + "; use .yaml, .json or .csv")
+        }
+    }
+    sheetsService, err = sheets.New(client)
+    if err != nil {
+        return nil, err
+    }
+    return &sheetsPolicySource{*cliPtr.policySpreadsheetId, policyRange}, nil
+}
+
+func (source *sheetsPolicySource) Load() ([]*folderPolicyStruct, error) {
+
+    var rowArr [][]string
+
+    sheetRespValuesArr, err := getSheetData(sheetsService, source.spreadsheetId, source.readRange)
+    if err != nil {
+        return nil, err
+    }
+    for _, sheetRow := range sheetRespValuesArr {
+        row := make([]string, len(sheetRow))
+        for index, cell := range sheetRow {
+            row[index] = fmt.Sprint(cell)
+        }
+        rowArr = append(rowArr, row)
+    }
+    return getPolicyArr(rowArr)
+}
+
+func (source *yamlPolicySource) Load() ([]*folderPolicyStruct, error) {
+
+    var policyArr []*folderPolicyStruct
+
+    byt, err := ioutil.ReadFile(source.path)
+    if err != nil {
+        return nil, err
+    }
+    if err := yaml.UnmarshalStrict(byt, &policyArr); err != nil {
+        return nil, fmt.Errorf("Unable to parse %s: %v", source.path, err)
+    }
+    return checkPolicyArr(policyArr)
+}
+
+func (source *jsonPolicySource) Load() ([]*folderPolicyStruct, error) {
+
+    var policyArr []*folderPolicyStruct
+
+    file, err := os.Open(source.path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields() // catch typos in reviewed policy
+    if err := decoder.Decode(&policyArr); err != nil {
+        return nil, fmt.Errorf("Unable to parse %s: %v", source.path, err)
+    }
+    return checkPolicyArr(policyArr)
+}
+
+func (source *csvPolicySource) Load() ([]*folderPolicyStruct, error) {
+
+    file, err := os.Open(source.path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    reader := csv.NewReader(file)
+    reader.FieldsPerRecord = -1 // the role column is optional
+    rowArr, err := reader.ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("Unable to parse %s: %v", source.path, err)
+    }
+    return getPolicyArr(rowArr)
+}
+
+// Group entries in the policy are email addresses; domains don't have an @
+func isGroup(domain string) bool {
+    return strings.Contains(domain, "@")
+}
+
+// Look up the members of the groups in the policy once, rather than per permission
+func setupGroupPolicy(client *http.Client) {
+
+    var err error
+
+    for _, folder := range folderPolicyArr {
+        if !isGroup(folder.Domain) {
+            continue
+        }
+        if !*cliPtr.groupPolicy {
+            logIt(nil, "Group " + folder.Domain + " in policy only permits shares to the group itself; use -g to permit its members", warning)
+            continue
+        }
+        if adminService == nil {
+            adminService, err = admin.New(client)
+            if err != nil {
+                logIt(err, "Unable to create Admin Directory client", fatal)
+            }
+        }
+        if _, ok := groupMemberMap[folder.Domain]; ok {
+            continue // listed against several folders
+        }
+        groupMemberMap[folder.Domain] = make(map[string]struct{})
+        err = getGroupMembers(folder.Domain, groupMemberMap[folder.Domain], make(map[string]struct{}))
+        if err != nil {
+            logIt(err, "Unable to get members of group " + folder.Domain + "; ", warning)
+        }
+    }
+}
+
+// Adds the group's members to memberMap, recursing into nested groups;
+// visitedMap guards against groups which are members of each other
+func getGroupMembers(groupEmail string, memberMap map[string]struct{}, visitedMap map[string]struct{}) error {
+
+    var nextPageToken string = ""
+
+    visitedMap[groupEmail] = struct{}{}
+    for {
+        atomic.AddUint64(&apiCallCount, 1) // Directory quota, so not throttled
+        r, err := adminService.Members.List(groupEmail).MaxResults(200).PageToken(nextPageToken).Do()
+        if err != nil {
+            return err
+        }
+        for _, member := range r.Members {
+            email := strings.ToLower(member.Email)
+            if member.Type == "GROUP" {
+                memberMap[email] = struct{}{} // shares to a nested group pass too
+                if _, ok := visitedMap[email]; !ok {
+                    if err := getGroupMembers(email, memberMap, visitedMap); err != nil {
+                        return err
+                    }
+                }
+            } else if email != "" { // customer members have no email
+                memberMap[email] = struct{}{}
+            }
+        }
+        nextPageToken = r.NextPageToken
+        if nextPageToken == "" {
+            break
         }
     }
+    return nil
+}
+
+// Group permissions pass if the group is permitted, and user permissions if the user is a member of a permitted group
+func groupRole(permission *drive.Permission, permittedDomainMap map[string]string) (string, bool) {
+
+    var (
+        role string
+        match bool
+    )
+
+    emailAddress := strings.ToLower(permission.EmailAddress)
+    if permission.Type != "user" && permission.Type != "group" {
+        return "", false
+    }
+    for permitted, permittedRole := range permittedDomainMap {
+        _, member := groupMemberMap[permitted][emailAddress]
+        if member || permitted == emailAddress && permission.Type == "group" {
+            role = maxRole(role, permittedRole, match)
+            match = true
+        }
+    }
+    return role, match
+}
+
+// The most permissive maximum role the policy allows the permission via its domain, a permitted group or public;
+// false if the policy doesn't permit it at all
+func policyRole(permission *drive.Permission, domain string, permittedDomainMap map[string]string) (string, bool) {
+
+    var (
+        role string
+        match bool
+    )
+
+    if domainRole, ok := permittedDomainMap[domain]; ok {
+        role, match = domainRole, true
+    }
+    if publicRole, ok := permittedDomainMap["public"]; ok {
+        role = maxRole(role, publicRole, match)
+        match = true
+    }
+    if memberRole, ok := groupRole(permission, permittedDomainMap); ok {
+        role = maxRole(role, memberRole, match)
+        match = true
+    }
+    return role, match
+}
+
+// Permit the domain up to role, keeping the most permissive maximum role if it's already permitted
+func permitRole(permittedDomainMap map[string]string, domain string, role string) {
+    existingRole, ok := permittedDomainMap[domain]
+    permittedDomainMap[domain] = maxRole(existingRole, role, ok)
+}
+
+// The more permissive of two maximum roles, where empty permits any role; role1 is ignored if it's not set
+func maxRole(role1 string, role2 string, role1Set bool) string {
+    if !role1Set {
+        return role2
+    }
+    if role1 == "" || role2 == "" {
+        return ""
+    }
+    if roleRankMap[role1] >= roleRankMap[role2] {
+        return role1
+    }
+    return role2
+}
+
+// v2 expresses commenter as reader with an additional role
+// Whether the permission's role is above the maximum; "" permits any role.
+// Owners can't be downgraded, only transferred, so never exceed. Shared drive organizers and
+// file organizers rank above writer, so a writer maximum downgrades drive members too.
+func roleExceeds(permission *drive.Permission, permittedRole string) bool {
+    role := permissionRole(permission)
+    if permittedRole == "" || role == "owner" {
+        return false
+    }
+    return roleRankMap[role] > roleRankMap[permittedRole]
+}
 
-    return policyArr
+func permissionRole(permission *drive.Permission) string {
+    if permission.Role == "reader" {
+        for _, additionalRole := range permission.AdditionalRoles {
+            if additionalRole == "commenter" {
+                return "commenter"
+            }
+        }
+    }
+    return permission.Role
 }
 
 func parseTemplate(data *notificationTemplate) (string, error) {
@@ -650,7 +2943,7 @@ func parseTemplate(data *notificationTemplate) (string, error) {
 
 // Sending html emails: http://www.blog.labouardy.com/sending-html-email-using-go/
 //func sendMailFromTemplate(mailHeader map[string]string, cliPtr *cliPtrStruct, folderPolicyWithNameMap map[string]map[string]string, logArr []string, notificationMap map[string]*notificationStruct) {
-func sendMailFromTemplate(mailHeader map[string]string, folderPolicyArr []*folderPolicyStruct, logArr []string, notificationMap map[string]*notificationStruct) {
+func sendMailFromTemplate(mailHeader map[string]string, folderPolicyArr []*folderPolicyStruct, logArr []string, notificationMap map[string]*notificationStruct, resolvedArr []*findingStruct, owner string, ownerCountMap map[string]int) {
 
     //type flagStruct map[string]string
     var ( 
@@ -672,8 +2965,10 @@ func sendMailFromTemplate(mailHeader map[string]string, folderPolicyArr []*folde
         f := cliPtrReflect.Field(i)
             flag = typeOfCliPtr.Field(i).Name
             flagVal = fmt.Sprintf("%v",reflect.Value(f).Elem())
+            flagValArr, _ := reflect.Value(f).Elem().Interface().([]string) // eg. several -r
             flagArr = append(flagArr, &flagStruct{flag, 
-                                                flagVal})         
+                                                flagVal,
+                                                flagValArr})         
     }
 
     templateStruct = &notificationTemplate{
@@ -682,6 +2977,9 @@ func sendMailFromTemplate(mailHeader map[string]string, folderPolicyArr []*folde
             folderPolicyArr,
             logArr,
             notificationMap,
+            resolvedArr,
+            owner,
+            ownerCountMap,
         }
     body, err := parseTemplate(templateStruct) 
     
@@ -728,7 +3026,8 @@ func logIt(err error, msg string, logLevel string) {
             if gapiErr.Code == 403 {
                 // concat more efficient than fmt.Sprintf: 
                 // https://gist.github.com/dtjm/c6ebc86abe7515c988ec
-                msg += "; delete token.json and re-run - " + err.Error() 
+                // the token's scopes are checked up front, so this is usually a missing permission on the item
+                msg += "; check the item is shared with the account, or run auth status to see the token's scopes - " + err.Error() 
             } else {
                 msg += " - " + err.Error()
             }
@@ -738,7 +3037,9 @@ func logIt(err error, msg string, logLevel string) {
     }  
 
     // Email
+    logMutex.Lock()
     logArr = append(logArr, msg)
+    logMutex.Unlock()
     switch logLevel {
     case fatal:       
         logCritical.Println(msg) // Log to Stackdriver before terminating shell
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "oauth"
+
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+
+    "google.golang.org/api/drive/v2"
+)
+
+func TestRoleExceeds(t *testing.T) {
+    tests := []struct {
+        name string
+        permission *drive.Permission
+        permittedRole string
+        want bool
+    }{
+        {"any role permitted", &drive.Permission{Role: "writer"}, "", false},
+        {"within maximum", &drive.Permission{Role: "reader"}, "writer", false},
+        {"above maximum", &drive.Permission{Role: "writer"}, "reader", true},
+        {"commenter above reader", &drive.Permission{Role: "reader", AdditionalRoles: []string{"commenter"}}, "reader", true},
+        {"owner never exceeds", &drive.Permission{Role: "owner"}, "writer", false},
+        {"owner never exceeds reader", &drive.Permission{Role: "owner"}, "reader", false},
+        {"organizer above writer", &drive.Permission{Role: "organizer"}, "writer", true},
+        {"file organizer above writer", &drive.Permission{Role: "fileOrganizer"}, "writer", true},
+        {"organizer within organizer", &drive.Permission{Role: "organizer"}, "organizer", false},
+        {"organizer above file organizer", &drive.Permission{Role: "organizer"}, "fileOrganizer", true},
+    }
+    for _, test := range tests {
+        if got := roleExceeds(test.permission, test.permittedRole); got != test.want {
+            t.Errorf("%s: roleExceeds(%s, %q) = %v, want %v", test.name, test.permission.Role, test.permittedRole, got, test.want)
+        }
+    }
+}
+
+func TestCheckPolicyArrRoles(t *testing.T) {
+    for _, role := range []string{"", "reader", "commenter", "writer", "fileOrganizer", "organizer"} {
+        if _, err := checkPolicyArr([]*folderPolicyStruct{{Id: "f", Domain: "example.com", Role: role}}); err != nil {
+            t.Errorf("role %q: unexpected error %v", role, err)
+        }
+    }
+    for _, role := range []string{"owner", "editor"} {
+        if _, err := checkPolicyArr([]*folderPolicyStruct{{Id: "f", Domain: "example.com", Role: role}}); err == nil {
+            t.Errorf("role %q: expected an error", role)
+        }
+    }
+}
+
+func TestQueueFolderVisited(t *testing.T) {
+    visitedFolderMap = make(map[string]*visitedFolderStruct)
+    itemWithPolicyMap = make(map[string]*itemWithPolicyStruct)
+    queue := newFolderQueue()
+
+    // reached from the first root, and listed: a file and a subfolder, with the subfolder listed too
+    folder := &drive.File{Id: "folder", MimeType: folderMimeType}
+    subfolder := &drive.File{Id: "subfolder", MimeType: folderMimeType}
+    file := &drive.File{Id: "file"}
+    nestedFile := &drive.File{Id: "nestedFile"}
+    queueFolder(queue, folder, map[string]string{"a.com": "reader"})
+    visitedFolderMap["folder"].itemArr = []*drive.File{file, subfolder}
+    fileDomainMap := map[string]string{"a.com": "reader"}
+    upsertItemDetail(file, fileDomainMap)
+    subfolderDomainMap := map[string]string{"a.com": "reader"}
+    queueFolder(queue, subfolder, subfolderDomainMap)
+    upsertItemDetail(subfolder, subfolderDomainMap)
+    visitedFolderMap["subfolder"].itemArr = []*drive.File{nestedFile}
+    upsertItemDetail(nestedFile, map[string]string{"a.com": "reader"})
+
+    // reached again from the second root, or another parent
+    queueFolder(queue, folder, map[string]string{"a.com": "writer", "b.com": "reader"})
+    if queue.pending != 2 {
+        t.Errorf("%d folders queued, want the folder and subfolder once each", queue.pending)
+    }
+    for _, id := range []string{"file", "subfolder", "nestedFile"} {
+        domainMap := itemWithPolicyMap[id].permittedDomainMap
+        if domainMap["a.com"] != "writer" || domainMap["b.com"] != "reader" {
+            t.Errorf("%s permits %v, want the union of both paths' domains", id, domainMap)
+        }
+    }
+
+    // nothing new, so nothing to pass down
+    if permitDomains(visitedFolderMap["folder"].permittedDomainMap, map[string]string{"a.com": "reader"}) {
+        t.Error("a lesser role was counted as new")
+    }
+}
+
+func TestWritePrivateFile(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "plan.json")
+    for _, content := range []string{"first", "second"} {
+        if err := writePrivateFile(path, []byte(content)); err != nil {
+            t.Fatal(err)
+        }
+        byt, err := ioutil.ReadFile(path)
+        if err != nil || string(byt) != content {
+            t.Errorf("got %q, %v; want %q", byt, err, content)
+        }
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if mode := info.Mode().Perm(); mode != 0600 {
+        t.Errorf("mode %o, want 0600", mode)
+    }
+    // no temporary files left behind
+    if fileArr, _ := ioutil.ReadDir(dir); len(fileArr) != 1 {
+        t.Errorf("%d files in the directory, want 1", len(fileArr))
+    }
+}
+
+func TestProfileCredentialFile(t *testing.T) {
+    // shared with Groupcount, so with both its credentials.json and a credentials directory of keys
+    profile := &oauth.Profile{Name: "tenant", Dir: t.TempDir()}
+    if err := ioutil.WriteFile(profile.CredentialFile(), []byte(`{"installed": {}}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Mkdir(profile.Path(oauth.ProfileCredentialDir), 0700); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkCredentialFile(profile.CredentialFile()); err != nil {
+        t.Errorf("credentials.json rejected: %v", err)
+    }
+    // eg. --credentials pointing at the directory
+    if err := checkCredentialFile(profile.Path(oauth.ProfileCredentialDir)); err == nil {
+        t.Error("credentials directory accepted")
+    }
+    if err := checkCredentialFile(""); err != nil {
+        t.Errorf("application default credentials rejected: %v", err)
+    }
+}
+
+func TestOwnerMail(t *testing.T) {
+    folderPolicyArr := []*folderPolicyStruct{
+        {Id: "root", Name: "Root", Domain: "example.com"},
+        {Id: "partners", Name: "Partners", Domain: "partner.com", Role: "reader"},
+    }
+    notificationMap := map[string]*notificationStruct{
+        "item1": {
+            Name: "Budget", Url: "https://drive/item1", ItemType: "file",
+            OwnerMap: map[string]string{"alice@example.com": "Alice", "bob@example.com": "Bob"},
+            PermittedDomainMap: map[string]string{"example.com": "", "partner.com": "reader"},
+            PermissionMap: map[string]*permissionStruct{"eve@elsewhere.com": {Role: "writer"}},
+        },
+        "item2": {
+            Name: "Roadmap", Url: "https://drive/item2", ItemType: "file",
+            OwnerMap: map[string]string{"bob@example.com": "Bob", "mallory@outside.com": "Mallory"},
+            PermittedDomainMap: map[string]string{"example.com": ""},
+            PermissionMap: map[string]*permissionStruct{"anyone": {Role: "reader"}},
+        },
+    }
+
+    ownerMap, skippedArr := ownerNotifications(notificationMap, folderPolicyArr)
+    if len(skippedArr) != 1 || skippedArr[0] != "mallory@outside.com" {
+        t.Errorf("skipped %v, want the owner outside the policy's domains", skippedArr)
+    }
+    if _, ok := ownerMap["mallory@outside.com"]; ok {
+        t.Error("owner outside the policy's domains would be mailed")
+    }
+
+    body, err := parseTemplate(&notificationTemplate{
+        Header: "Drive policy",
+        FolderPolicyArr: folderPolicyArr, // even if passed, an owner's mail doesn't show it
+        NotificationMap: ownerMap["alice@example.com"],
+        Owner: "alice@example.com",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"Budget", "eve@elsewhere.com"} {
+        if !strings.Contains(body, want) {
+            t.Errorf("owner mail lacks %q", want)
+        }
+    }
+    for _, unwanted := range []string{"Roadmap", "Permitted domain shares", "partner.com", "Partners", "Bob", "Command Line Flags"} {
+        if strings.Contains(body, unwanted) {
+            t.Errorf("owner mail contains %q", unwanted)
+        }
+    }
+
+    // the mailTo report still has everything
+    body, err = parseTemplate(&notificationTemplate{Header: "Drive policy", FolderPolicyArr: folderPolicyArr, NotificationMap: notificationMap})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"Budget", "Roadmap", "Permitted domain shares", "partner.com", "Mallory"} {
+        if !strings.Contains(body, want) {
+            t.Errorf("mailTo report lacks %q", want)
+        }
+    }
+}
+
+// Run with -race: the workers log concurrently
+func TestLogItConcurrent(t *testing.T) {
+    logInfo = log.New(ioutil.Discard, "", 0)
+    log.SetOutput(ioutil.Discard)
+    defer log.SetOutput(os.Stderr)
+    logArr = nil
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(worker int) {
+            defer wg.Done()
+            for j := 0; j < 100; j++ {
+                logIt(nil, fmt.Sprintf("worker %d message %d", worker, j), info)
+            }
+        }(i)
+    }
+    wg.Wait()
+    if len(logArr) != 800 {
+        t.Errorf("logged %d messages, want 800", len(logArr))
+    }
+}
@@ -17,8 +17,12 @@ limitations under the License.
 package main
 
 import (
+        "oauth" // from https://github.com/demoforwork/public/tree/master/oauth
+        "oauth/oauthcmd"
+
         "encoding/csv"
         "encoding/json"
+        "errors"
         "fmt"
         "html/template"
         "io/ioutil"
@@ -37,6 +41,7 @@ import (
 
         "golang.org/x/net/context"
 
+        "golang.org/x/oauth2"
         "golang.org/x/oauth2/google"
         "google.golang.org/api/admin/directory/v1"
         "google.golang.org/api/googleapi" // for error.Code
@@ -50,6 +55,9 @@ type cliPtrStruct struct {
         visType *string
         search *[]string      
         wait *int 
+        profile *string
+        credentials *string
+        adc *bool
 }
 
 type nodeStruct struct {
@@ -161,6 +169,7 @@ var (
         edges edgeArrStruct
         grpArr []*admin.Group
         apiCallCount uint64 // use to iterate over service accounts to stay within quota
+        retryTransport = oauth.NewRetryTransport(nil)
         // Hardcode the headers since getting struct fields via reflection
         // doesn't work with slices, and also need to get populated struct, ie. first record
         nodeHdrArr = []string{
@@ -181,6 +190,8 @@ var (
         //scopeArr = []string{admin.AdminDirectoryGroupReadonlyScope, admin.AdminDirectoryGroupMemberReadonlyScope}
         scopeArr = []string{admin.AdminDirectoryGroupScope, admin.AdminDirectoryGroupMemberScope}
         authIdDescription = "group admin id"
+        credentialPath = credentialDir // service account keys; within the profile directory if a profile is selected
+        tokenStore oauth.TokenStore = oauth.NewFileTokenStore(oauth.DefaultTokenFile) // for installed-app credentials
 )
 
 func check(e error) {
@@ -194,7 +205,7 @@ func check(e error) {
 func main() {
 
         app := cli.App("./groupCount", "List Groups and Count Parents") // first argument must match executable name
-        app.Spec = "DOMAIN GRP_ADMIN_ID -p [-v SEARCH...] [-w]"
+        app.Spec = "[DOMAIN GRP_ADMIN_ID] [-p] [-v SEARCH...] [-w] [--profile] [--credentials | --adc]"
         // Define top-level global options   
         cliPtr = &cliPtrStruct{
                 domain: app.StringArg("DOMAIN", "", "domain"),
@@ -203,6 +214,14 @@ func main() {
                 visType: app.StringOpt("v visType", "", "parents/search: parent tree or search by prefix"),
                 search: app.StringsArg("SEARCH", []string{""}, "parents: identity (user, service account, or group) whose parents to map, including domain suffix; search: group prefix for which to search"),
                 wait: app.IntOpt("w wait", 0, "seconds each goroutine sleeps; set to 1 to prevent exceeding user queries per 100 seconds quota"),     
+                profile: app.String(cli.StringOpt{
+                        Name: "profile",
+                        Value: "",
+                        Desc: "named credential profile, eg. one per tenant, with its own credentials directory of service account keys, or credentials.json, and additional scopes",
+                        EnvVar: oauth.ProfileEnv,
+                }),
+                credentials: app.StringOpt("credentials", "", "service account key or installed-app client secret file, or a directory of them; defaults to the credentials directory, or the profile's"),
+                adc: app.BoolOpt("adc", false, "use application default credentials instead of credential files"),
         }
 
         app.Before = func() {
@@ -214,15 +233,40 @@ func main() {
                         log.Fatalf("Specify search prefix for group list")
                 } 
                 edgeObj.obj = make(map[string]nodeResolutionStruct)
+
+                if *cliPtr.profile != "" {
+                        profile, err := oauth.LoadProfile(*cliPtr.profile)
+                        if err != nil {
+                                log.Fatalf("Unable to load profile: %v", err)
+                        }
+                        credentialPath = profile.CredentialsPath()
+                        tokenStore = profile.TokenStore()
+                        // request the profile's scopes as well; delegated scopes must all be authorized for the service accounts in this tenant
+                        scopeArr = profile.MergeScopes(scopeArr)
+                }
+                if *cliPtr.credentials != "" {
+                        credentialPath = *cliPtr.credentials
+                }
         }
 
+        // auth login, auth status and auth revoke, for installed-app credentials
+        oauthcmd.Mount(app.Cmd, authSetup)
+
         // Specify the action to execute when the app is invoked correctly
         app.Action = func() {
+
+                // optional in the spec so the auth commands parse without them
+                if *cliPtr.domain == "" || *cliPtr.grpAdmin == "" {
+                        log.Fatalf("Specify DOMAIN and GRP_ADMIN_ID")
+                }
  
                 if *cliPtr.processType == "interact" {
                         webServer()
                 } else {
-                        srvArr := newAdminDirectoryServiceArr(*cliPtr.grpAdmin)
+                        srvArr, err := newAdminDirectoryServiceArr(*cliPtr.grpAdmin)
+                        if err != nil {
+                                log.Panic(err)
+                        }
                         if *cliPtr.visType == "parents" {                               
                                 for _, search := range *cliPtr.search {  
                                         nodes.arr = nil
@@ -240,6 +284,9 @@ func main() {
                                         writeGroupsByPrefix(search)
                                 }
                         }
+                        if retryCountMap := retryTransport.Counts(); len(retryCountMap) > 0 {
+                                fmt.Printf("Retries by reason: %v\n", retryCountMap)
+                        }
                 }                
         }
         
@@ -366,7 +413,11 @@ func listParents(writer http.ResponseWriter, request *http.Request) {
                 if key == "identity" {
                         if len(valueArr) > 0 { // there should be one and only one value
                                 search = valueArr[0]
-                                srvArr := newAdminDirectoryServiceArr(*cliPtr.grpAdmin)
+                                srvArr, err := newAdminDirectoryServiceArr(*cliPtr.grpAdmin, oauth.NonInteractive())
+                                if err != nil {
+                                        authError(writer, err)
+                                        return
+                                }
                                 nodes.arr = nil
                                 nodeJSONArr = nil
                                 edges.arr = nil
@@ -415,7 +466,11 @@ func listSearch(writer http.ResponseWriter, request *http.Request) {
                 if key == "prefix" {
                         if len(valueArr) > 0 { // there should be one and only one value
                                 search = valueArr[0]
-                                srvArr := newAdminDirectoryServiceArr(*cliPtr.grpAdmin)
+                                srvArr, err := newAdminDirectoryServiceArr(*cliPtr.grpAdmin, oauth.NonInteractive())
+                                if err != nil {
+                                        authError(writer, err)
+                                        return
+                                }
                                 grpArr = nil
                                 listGroupsByPrefix(srvArr, *cliPtr.domain, search)
                                 if len(grpArr) == 0 {
@@ -438,29 +493,69 @@ func listSearch(writer http.ResponseWriter, request *http.Request) {
 }
 
 
+// The web server can't run an authorization flow for a request, so a missing or insufficient token
+// is reported with how to fix it rather than as a server error
+func authError(writer http.ResponseWriter, err error) {
+        log.Println(err)
+        if errors.Is(err, oauth.ErrNoToken) || errors.Is(err, oauth.ErrScopeMismatch) {
+                http.Error(writer, "Not authorized: run ./groupCount auth login, then retry - " + err.Error(), http.StatusServiceUnavailable)
+                return
+        }
+        http.Error(writer, "Unable to authorize: " + err.Error(), http.StatusInternalServerError)
+}
+
 // Based on https://stackoverflow.com/questions/55867150/query-gsuite-directory-api-with-a-google-cloud-platform-service-account
 // Use multiple services to stay within Admin SDK quota
-func newAdminDirectoryServiceArr(grpAdminEmail string) []*admin.Service {
+// Each credential may be a service account key (delegated to the group admin) or an installed-app client secret
+// (authorized as the group admin); with --adc, application default credentials are used instead.
+// Returns an error rather than panicking so the web server can surface it; pass oauth.NonInteractive() there,
+// so a missing token returns ErrNoToken instead of waiting on a consent screen no one will see.
+func newAdminDirectoryServiceArr(grpAdminEmail string, opts ...oauth.Option) ([]*admin.Service, error) {
         var (
                 srvArr []*admin.Service 
                 globalErr error // thrown err only has scope within for loop
+                credentialFileArr []string
         )
-        credentialFiles, err := ioutil.ReadDir(credentialDir)
-        check(err)
+        // retry transient errors, including rate limits, beneath the OAuth transport so every service account's client shares it
+        ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: retryTransport})
+        credOpts := oauth.CredentialOptions{Subject: grpAdminEmail, Scopes: scopeArr}
+
+        if *cliPtr.adc {
+                creds, err := oauth.FindCredentials(ctx, credOpts)
+                if err != nil {
+                        return nil, err
+                }
+                srv, err := admin.New(oauth2.NewClient(ctx, creds.TokenSource))
+                if err != nil {
+                        return nil, err
+                }
+                return []*admin.Service{srv}, nil
+        }
 
-        for _, file := range credentialFiles {
-                jsonCredentials, err := ioutil.ReadFile(filepath.Join(credentialDir, file.Name()))
+        // a single credential file, or a directory of them
+        info, err := os.Stat(credentialPath)
+        if err != nil {
+                return nil, err
+        }
+        if info.IsDir() {
+                credentialFiles, err := ioutil.ReadDir(credentialPath)
+                if err != nil {
+                        return nil, err
+                }
+                for _, file := range credentialFiles {
+                        credentialFileArr = append(credentialFileArr, filepath.Join(credentialPath, file.Name()))
+                }
+        } else {
+                credentialFileArr = []string{credentialPath}
+        }
+
+        for _, credentialFile := range credentialFileArr {
+                credOpts.File = credentialFile
+                creds, err := oauth.FindCredentials(ctx, credOpts, append([]oauth.Option{oauth.WithTokenStore(tokenStore)}, opts...)...)
                 if err != nil {
                         globalErr = err; // err only has scope within for loop                        
                 } else {
-                        config, _ := google.JWTConfigFromJSON(
-                                        jsonCredentials,
-                                        scopeArr...
-                                        )
-                        config.Subject = grpAdminEmail
-
-                        ctx := context.Background()
-                        client := config.Client(ctx)
+                        client := oauth2.NewClient(ctx, creds.TokenSource)
 
                         srv, err := admin.New(client)
                         if err != nil {
@@ -470,11 +565,51 @@ func newAdminDirectoryServiceArr(grpAdminEmail string) []*admin.Service {
                         }
                 } 
         }
-        if globalErr != nil && len(srvArr) == 0 {
-                log.Panic(globalErr) // log the last error
+        if len(srvArr) == 0 {
+                if globalErr == nil {
+                        globalErr = errors.New("no credentials found in " + credentialPath)
+                }
+                return nil, globalErr // the last error
         } // else continue with those credentials which were successfully retrieved 
        
-        return srvArr
+        return srvArr, nil
+}
+
+// The installed-app client secret for the auth commands: the credential file, or the first one in the credential directory
+func authSetup() (*oauthcmd.Auth, error) {
+        var credentialFileArr []string
+
+        if *cliPtr.adc {
+                return nil, errors.New("the auth commands manage the cached user token; application default credentials have none")
+        }
+        info, err := os.Stat(credentialPath)
+        if err != nil {
+                return nil, err
+        }
+        if info.IsDir() {
+                credentialFiles, err := ioutil.ReadDir(credentialPath)
+                if err != nil {
+                        return nil, err
+                }
+                for _, file := range credentialFiles {
+                        credentialFileArr = append(credentialFileArr, filepath.Join(credentialPath, file.Name()))
+                }
+        } else {
+                credentialFileArr = []string{credentialPath}
+        }
+
+        for _, credentialFile := range credentialFileArr {
+                byt, err := ioutil.ReadFile(credentialFile)
+                if err != nil {
+                        return nil, err
+                }
+                // service account keys don't parse as a client secret
+                config, err := google.ConfigFromJSON(byt, scopeArr...)
+                if err == nil {
+                        return &oauthcmd.Auth{Config: config, Store: tokenStore, Flow: oauth.LoopbackFlow}, nil
+                }
+        }
+        return nil, errors.New("no installed-app client secret found in " + credentialPath + "; service account keys have no cached token to manage")
 }
 
 
@@ -519,37 +654,18 @@ func getGroupsForIdentity(srvArr []*admin.Service, grpDomain string, parentId in
                                 UserKey(identity).
                                 MaxResults(maxResults).PageToken(nextPageToken). //MaxResults(10).
                                 OrderBy("email").Do()
+                // transient errors have already been retried by retryTransport
                 if err != nil {
                         if gapiErr, ok := err.(*googleapi.Error); ok {
-                               if gapiErr.Code == 500 { // internal error
-                                        // retry once after 1 second: implement own retry since backoff libraries may not be threadsafe
-                                        time.Sleep(time.Second)
-                                        r, err = srv.Groups.List().
-                                                        Domain(grpDomain).
-                                                        UserKey(identity).
-                                                        MaxResults(maxResults).PageToken(nextPageToken). //MaxResults(10).
-                                                        OrderBy("email").Do()
-                                        if err != nil {
-                                                if gapiErr, ok := err.(*googleapi.Error); ok {
-                                                        if gapiErr.Code == 403 { // authorization error
-                                                                log.Fatalf("Is " + *cliPtr.grpAdmin + " the correct " + authIdDescription + "?",err);                                                           
-                                                        } else if gapiErr.Code == 400 { // couldn't find group
-                                                                // ignore
-                                                        } else {
-                                                              check(err)  
-                                                        }
-                                                } else {
-                                                        check(err)
-                                                }
-                                        }
-                                } else if gapiErr.Code == 403 { // authorization error
+                                if gapiErr.Code == 403 { // authorization error
                                         log.Fatalf("Is " + *cliPtr.grpAdmin + " the correct " + authIdDescription + "?",err);                                                           
                                 } else if gapiErr.Code == 400 { // couldn't find group
                                         // ignore
                                 } else {
                                       check(err)  
                                 }
-                        }          
+                        }
+                        // other errors, such as a cancelled request, end this identity's list rather than the server
                 } 
                 if err != nil {
                         break
@@ -718,22 +834,8 @@ func listGroupsByPrefix(srvArr []*admin.Service, grpDomain string, grpPrefix str
                                 Query("email:{"+grpPrefix+"}*").
                                 MaxResults(maxResults).PageToken(nextPageToken). //MaxResults(10).
                                 OrderBy("email").Do()
-                if err != nil {
-                        if gapiErr, ok := err.(*googleapi.Error); ok {
-                                if gapiErr.Code == 500 { // internal error
-                                        // retry once after 1 second: implement own retry since backoff libraries may not be threadsafe
-                                        time.Sleep(time.Second)
-                                        r, err = srv.Groups.List().
-                                                        Domain(grpDomain).
-                                                        Query("email:{"+grpPrefix+"}*").
-                                                        MaxResults(maxResults).PageToken(nextPageToken). //MaxResults(10).
-                                                        OrderBy("email").Do()
-                                        check(err)
-                                } else {
-                                        check(err)
-                                }
-                        }          
-                } 
+                // transient errors have already been retried by retryTransport
+                check(err)
 
                 grpArr = append(grpArr,r.Groups...)
 
@@ -0,0 +1,104 @@
+package oauth
+
+import (
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io/ioutil"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2/google"
+)
+
+// Which credential to use; the same for every tool so each can run under any of them
+type CredentialOptions struct {
+        // Installed-app client secret or service account key; empty for Application Default Credentials
+        File string
+        // User to impersonate via domain-wide delegation; applies to service accounts only,
+        // since user credentials act as the user who authorized them
+        Subject string
+        Scopes []string
+}
+
+// Fields used to tell the credential types apart
+type credentialFile struct {
+        Type string `json:"type"`
+        Installed *struct {
+                ProjectId string `json:"project_id"`
+        } `json:"installed"`
+        Web *struct {
+                ProjectId string `json:"project_id"`
+        } `json:"web"`
+}
+
+// One factory for installed-app OAuth, service account keys with an optional delegated subject,
+// and Application Default Credentials.
+// opts (token store, flow etc.) apply to installed-app credentials only.
+func FindCredentials(ctx context.Context, credOpts CredentialOptions, opts ...Option) (*google.Credentials, error) {
+        if credOpts.File == "" {
+                return defaultCredentials(ctx, credOpts)
+        }
+        byt, err := ioutil.ReadFile(credOpts.File)
+        if err != nil {
+                return nil, fmt.Errorf("unable to read credential file: %v", err)
+        }
+        return CredentialsFromJSON(ctx, byt, credOpts, opts...)
+}
+
+// Same as FindCredentials, for credential file contents
+func CredentialsFromJSON(ctx context.Context, byt []byte, credOpts CredentialOptions, opts ...Option) (*google.Credentials, error) {
+        var f credentialFile
+        if err := json.Unmarshal(byt, &f); err != nil {
+                return nil, fmt.Errorf("unable to parse credential file: %v", err)
+        }
+
+        switch {
+        case f.Installed != nil || f.Web != nil:
+                config, err := google.ConfigFromJSON(byt, credOpts.Scopes...)
+                if err != nil {
+                        return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+                }
+                tokenSource, err := GetTokenSourceContext(ctx, config, opts...)
+                if err != nil {
+                        return nil, err
+                }
+                projectId := ""
+                if f.Installed != nil {
+                        projectId = f.Installed.ProjectId
+                } else {
+                        projectId = f.Web.ProjectId
+                }
+                return &google.Credentials{ProjectID: projectId, TokenSource: tokenSource, JSON: byt}, nil
+        case f.Type == "service_account":
+                return google.CredentialsFromJSONWithParams(ctx, byt, google.CredentialsParams{
+                        Scopes: credOpts.Scopes,
+                        Subject: credOpts.Subject,
+                })
+        default:
+                return nil, fmt.Errorf("unsupported credential type %q; use an installed-app client secret or a service account key", f.Type)
+        }
+}
+
+// Whether the credentials are from a service account key, so can impersonate users via domain-wide delegation
+func IsServiceAccount(creds *google.Credentials) bool {
+        var f credentialFile
+        return creds.JSON != nil && json.Unmarshal(creds.JSON, &f) == nil && f.Type == "service_account"
+}
+
+// Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS, gcloud's user credentials or the metadata server
+func defaultCredentials(ctx context.Context, credOpts CredentialOptions) (*google.Credentials, error) {
+        creds, err := google.FindDefaultCredentialsWithParams(ctx, google.CredentialsParams{
+                Scopes: credOpts.Scopes,
+                Subject: credOpts.Subject,
+        })
+        if err != nil {
+                return nil, fmt.Errorf("unable to find application default credentials: %v", err)
+        }
+        if credOpts.Subject != "" {
+                // only key files can sign the delegated assertion; the metadata server and gcloud credentials ignore the subject
+                if !IsServiceAccount(creds) {
+                        return nil, errors.New("delegation to " + credOpts.Subject + " requires application default credentials from a service account key file")
+                }
+        }
+        return creds, nil
+}
@@ -0,0 +1,73 @@
+package oauth
+
+import (
+        "fmt"
+        "strings"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Google's device authorization endpoint; older credentials.json parsers don't set it
+const googleDeviceAuthURL = "https://oauth2.googleapis.com/device/code"
+
+// The only scopes Google allows the device flow:
+// https://developers.google.com/identity/protocols/oauth2/limited-input-device#allowedscopes
+var deviceScopeMap = map[string]bool{
+        "openid": true,
+        "email": true,
+        "profile": true,
+        "https://www.googleapis.com/auth/userinfo.email": true,
+        "https://www.googleapis.com/auth/userinfo.profile": true,
+        "https://www.googleapis.com/auth/drive.appdata": true,
+        "https://www.googleapis.com/auth/drive.file": true,
+        "https://www.googleapis.com/auth/youtube": true,
+        "https://www.googleapis.com/auth/youtube.readonly": true,
+}
+
+// Shows the user code and verification URL for the device flow.
+// Replace to surface these some other way, eg. in a web UI.
+var ShowDeviceCode = func(verificationURL string, userCode string) {
+        fmt.Printf("On any device with a browser, go to\n%v\nand enter the code %v\n", verificationURL, userCode)
+}
+
+// Device authorization grant for headless runs (build boxes, jump hosts):
+// prints a user code and verification URL the user can open from a phone,
+// then polls the token endpoint until the user consents.
+// Polling backs off on slow_down and keeps waiting on authorization_pending.
+// The OAuth client must be of type "TVs and Limited Input devices".
+// Google allows it only a few scopes, so other scopes return ErrDeviceScope before a code is shown.
+func DeviceFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+
+        var disallowedArr []string
+        for _, scope := range config.Scopes {
+                if !deviceScopeMap[scope] {
+                        disallowedArr = append(disallowedArr, scope)
+                }
+        }
+        if len(disallowedArr) > 0 {
+                return nil, fmt.Errorf("%w: %s; use the loopback flow or a service account", ErrDeviceScope, strings.Join(disallowedArr, ", "))
+        }
+
+        deviceConfig := *config
+        if deviceConfig.Endpoint.DeviceAuthURL == "" {
+                deviceConfig.Endpoint.DeviceAuthURL = googleDeviceAuthURL
+        }
+
+        resp, err := deviceConfig.DeviceAuth(ctx)
+        if err != nil {
+                return nil, fmt.Errorf("unable to request device code: %v", err)
+        }
+
+        verificationURL := resp.VerificationURIComplete
+        if verificationURL == "" {
+                verificationURL = resp.VerificationURI
+        }
+        ShowDeviceCode(verificationURL, resp.UserCode)
+
+        tok, err := deviceConfig.DeviceAccessToken(ctx, resp)
+        if err != nil {
+                return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+        }
+        return tok, nil
+}
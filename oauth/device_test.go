@@ -0,0 +1,91 @@
+package oauth
+
+import (
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+
+        "golang.org/x/net/context"
+)
+
+// Fake device and token endpoints: the token endpoint is pending until polled pendingPolls times
+func newFakeDeviceServer(t *testing.T, pendingPolls int) (*httptest.Server, *int) {
+        var deviceRequests int
+        polls := 0
+        mux := http.NewServeMux()
+        mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+                deviceRequests++
+                w.Header().Set("Content-Type", "application/json")
+                fmt.Fprint(w, `{"device_code": "device", "user_code": "ABCD-EFGH", "verification_url": "https://www.google.com/device", "expires_in": 60, "interval": 1}`)
+        })
+        mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+                r.ParseForm()
+                w.Header().Set("Content-Type", "application/json")
+                if r.Form.Get("device_code") != "device" {
+                        w.WriteHeader(http.StatusBadRequest)
+                        fmt.Fprint(w, `{"error": "invalid_grant"}`)
+                        return
+                }
+                polls++
+                if polls <= pendingPolls {
+                        w.WriteHeader(http.StatusPreconditionRequired)
+                        fmt.Fprint(w, `{"error": "authorization_pending"}`)
+                        return
+                }
+                fmt.Fprint(w, `{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`)
+        })
+        server := httptest.NewServer(mux)
+        t.Cleanup(server.Close)
+        return server, &deviceRequests
+}
+
+func fakeDeviceCode(t *testing.T) *string {
+        var shown string
+        showDeviceCode := ShowDeviceCode
+        t.Cleanup(func() { ShowDeviceCode = showDeviceCode })
+        ShowDeviceCode = func(verificationURL string, userCode string) {
+                shown = verificationURL + " " + userCode
+        }
+        return &shown
+}
+
+func TestDeviceFlow(t *testing.T) {
+        server, _ := newFakeDeviceServer(t, 1)
+        shown := fakeDeviceCode(t)
+        config := fakeConfig(server.URL + "/token")
+        config.Endpoint.DeviceAuthURL = server.URL + "/device"
+        config.Scopes = []string{"https://www.googleapis.com/auth/drive.file"}
+
+        ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+        defer cancel()
+        tok, err := DeviceFlow(ctx, config)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+                t.Errorf("got token %+v", tok)
+        }
+        if *shown != "https://www.google.com/device ABCD-EFGH" {
+                t.Errorf("showed %q, want the verification URL and user code", *shown)
+        }
+}
+
+func TestDeviceFlowScopeNotAllowed(t *testing.T) {
+        server, deviceRequests := newFakeDeviceServer(t, 0)
+        shown := fakeDeviceCode(t)
+        config := fakeConfig(server.URL + "/token")
+        config.Endpoint.DeviceAuthURL = server.URL + "/device"
+        config.Scopes = []string{"https://www.googleapis.com/auth/drive.file", "https://www.googleapis.com/auth/gmail.send"}
+
+        _, err := DeviceFlow(context.Background(), config)
+        if !errors.Is(err, ErrDeviceScope) {
+                t.Fatalf("got %v, want ErrDeviceScope", err)
+        }
+        // up front, so the user isn't shown a code which can't work
+        if *deviceRequests != 0 || *shown != "" {
+                t.Errorf("requested %d device codes and showed %q, want none", *deviceRequests, *shown)
+        }
+}
@@ -0,0 +1,200 @@
+package oauth
+
+import (
+        "bytes"
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/rand"
+        "crypto/sha256"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "os"
+
+        "golang.org/x/crypto/scrypt"
+        "golang.org/x/oauth2"
+)
+
+// Environment variables for the encryption key; the key file takes precedence
+const (
+        TokenPassphraseEnv = "OAUTH_TOKEN_PASSPHRASE"
+        TokenKeyFileEnv = "OAUTH_TOKEN_KEY_FILE"
+)
+
+const (
+        encryptedTokenVersion = 1
+        kdfScrypt = "scrypt"
+        kdfKeyFile = "keyfile"
+        saltLen = 16
+)
+
+// On-disk form of the encrypted token
+type encryptedToken struct {
+        Version int `json:"version"`
+        KDF string `json:"kdf"`
+        Salt []byte `json:"salt,omitempty"` // scrypt only; base64 encoded by encoding/json
+        Nonce []byte `json:"nonce"`
+        Ciphertext []byte `json:"ciphertext"`
+}
+
+// Stores the token encrypted at rest with AES-256-GCM, since the refresh token
+// can be for an identity which can delete Drive permissions domain-wide.
+// The key is derived from a passphrase with scrypt, or from the contents of a key file.
+type EncryptedFileTokenStore struct {
+        Path string
+        passphrase []byte
+        fileKey []byte
+}
+
+func NewEncryptedFileTokenStore(path string, passphrase []byte) *EncryptedFileTokenStore {
+        return &EncryptedFileTokenStore{Path: path, passphrase: passphrase}
+}
+
+// Key file contents can be any high-entropy secret, eg. 32 random bytes, hex or base64
+func NewEncryptedFileTokenStoreWithKeyFile(path string, keyFile string) (*EncryptedFileTokenStore, error) {
+        byt, err := ioutil.ReadFile(keyFile)
+        if err != nil {
+                return nil, fmt.Errorf("unable to read token key file: %v", err)
+        }
+        byt = bytes.TrimSpace(byt)
+        if len(byt) == 0 {
+                return nil, errors.New("token key file " + keyFile + " is empty")
+        }
+        key := sha256.Sum256(byt)
+        return &EncryptedFileTokenStore{Path: path, fileKey: key[:]}, nil
+}
+
+// Key file path from OAUTH_TOKEN_KEY_FILE, or passphrase from OAUTH_TOKEN_PASSPHRASE
+func NewEncryptedFileTokenStoreFromEnv(path string) (*EncryptedFileTokenStore, error) {
+        if keyFile := os.Getenv(TokenKeyFileEnv); keyFile != "" {
+                return NewEncryptedFileTokenStoreWithKeyFile(path, keyFile)
+        }
+        if passphrase := os.Getenv(TokenPassphraseEnv); passphrase != "" {
+                return NewEncryptedFileTokenStore(path, []byte(passphrase)), nil
+        }
+        return nil, errors.New("set " + TokenKeyFileEnv + " or " + TokenPassphraseEnv + " to encrypt the token cache")
+}
+
+func (s *EncryptedFileTokenStore) Load() (*oauth2.Token, error) {
+        byt, err := ioutil.ReadFile(s.Path)
+        if err != nil {
+                return nil, err
+        }
+        enc := &encryptedToken{}
+        if err := json.Unmarshal(byt, enc); err != nil {
+                return nil, fmt.Errorf("unable to parse encrypted token file %s: %v", s.Path, err)
+        }
+        if enc.Version != encryptedTokenVersion {
+                return nil, fmt.Errorf("unsupported encrypted token version %d", enc.Version)
+        }
+        if (enc.KDF == kdfKeyFile) != (s.fileKey != nil) {
+                return nil, fmt.Errorf("token file %s was encrypted with a %s; set the matching environment variable", s.Path, kdfDescription(enc.KDF))
+        }
+
+        aead, err := s.aead(enc.Salt)
+        if err != nil {
+                return nil, err
+        }
+        plaintext, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+        if err != nil {
+                return nil, errors.New("unable to decrypt token file " + s.Path + "; wrong passphrase or key file?")
+        }
+        return decodeToken(bytes.NewReader(plaintext))
+}
+
+func (s *EncryptedFileTokenStore) Save(token *oauth2.Token) error {
+        var (
+                plaintext bytes.Buffer
+                salt []byte
+                kdf = kdfKeyFile
+        )
+
+        if err := encodeToken(&plaintext, token); err != nil {
+                return err
+        }
+        if s.fileKey == nil {
+                // fresh salt on each save so the same passphrase never yields the same key twice
+                kdf = kdfScrypt
+                salt = make([]byte, saltLen)
+                if _, err := rand.Read(salt); err != nil {
+                        return err
+                }
+        }
+        aead, err := s.aead(salt)
+        if err != nil {
+                return err
+        }
+        nonce := make([]byte, aead.NonceSize())
+        if _, err := rand.Read(nonce); err != nil {
+                return err
+        }
+
+        enc := &encryptedToken{
+                Version: encryptedTokenVersion,
+                KDF: kdf,
+                Salt: salt,
+                Nonce: nonce,
+                Ciphertext: aead.Seal(nil, nonce, plaintext.Bytes(), nil),
+        }
+        return writeFileAtomic(s.Path, func(w io.Writer) error {
+                return json.NewEncoder(w).Encode(enc)
+        })
+}
+
+func (s *EncryptedFileTokenStore) Delete() error {
+        err := os.Remove(s.Path)
+        if os.IsNotExist(err) {
+                return nil
+        }
+        return err
+}
+
+func (s *EncryptedFileTokenStore) aead(salt []byte) (cipher.AEAD, error) {
+        key := s.fileKey
+        if key == nil {
+                var err error
+                // scrypt parameters recommended for interactive logins in 2017
+                key, err = scrypt.Key(s.passphrase, salt, 1<<15, 8, 1, 32)
+                if err != nil {
+                        return nil, err
+                }
+        }
+        block, err := aes.NewCipher(key)
+        if err != nil {
+                return nil, err
+        }
+        return cipher.NewGCM(block)
+}
+
+func kdfDescription(kdf string) string {
+        if kdf == kdfKeyFile {
+                return "key file (" + TokenKeyFileEnv + ")"
+        }
+        return "passphrase (" + TokenPassphraseEnv + ")"
+}
+
+// Moves an existing plaintext token file, eg. token.json, into store and deletes the plaintext file.
+// Does nothing if there's no plaintext file, so it's safe to call on every run.
+// If store already holds a token, it's kept and the plaintext file is only warned about:
+// the plaintext token may be older, or another identity's.
+func MigratePlaintextToken(plaintextPath string, store TokenStore) error {
+        tok, err := tokenFromFile(plaintextPath)
+        if os.IsNotExist(err) {
+                return nil
+        }
+        if err != nil {
+                return fmt.Errorf("unable to read plaintext token file %s: %v", plaintextPath, err)
+        }
+        // even one that can't be decrypted, eg. with the wrong passphrase, shouldn't be overwritten
+        if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrNoToken) {
+                fmt.Printf("Warning: plaintext token file %s is still present alongside the encrypted token cache; delete it\n", plaintextPath)
+                return nil
+        }
+        if err := store.Save(tok); err != nil {
+                return fmt.Errorf("unable to migrate plaintext token file %s: %v", plaintextPath, err)
+        }
+        fmt.Printf("Migrated plaintext token file %s to the encrypted token cache\n", plaintextPath)
+        return os.Remove(plaintextPath)
+}
@@ -0,0 +1,83 @@
+package oauth
+
+import (
+        "os"
+        "path/filepath"
+        "testing"
+
+        "golang.org/x/oauth2"
+)
+
+func TestEncryptedTokenRoundTrip(t *testing.T) {
+        store := NewEncryptedFileTokenStore(filepath.Join(t.TempDir(), "token.json.enc"), []byte("passphrase"))
+        if err := store.Save(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+                t.Fatal(err)
+        }
+        tok, err := store.Load()
+        if err != nil {
+                t.Fatal(err)
+        }
+        if tok.RefreshToken != "refresh" {
+                t.Errorf("got refresh token %q", tok.RefreshToken)
+        }
+        if _, err := NewEncryptedFileTokenStore(store.Path, []byte("wrong")).Load(); err == nil {
+                t.Error("decrypted with the wrong passphrase")
+        }
+}
+
+func TestMigratePlaintextToken(t *testing.T) {
+        dir := t.TempDir()
+        plaintextPath := filepath.Join(dir, "token.json")
+        if err := saveToken(plaintextPath, &oauth2.Token{RefreshToken: "plaintext"}); err != nil {
+                t.Fatal(err)
+        }
+        store := NewEncryptedFileTokenStore(filepath.Join(dir, "token.json.enc"), []byte("passphrase"))
+
+        if err := MigratePlaintextToken(plaintextPath, store); err != nil {
+                t.Fatal(err)
+        }
+        tok, err := store.Load()
+        if err != nil || tok.RefreshToken != "plaintext" {
+                t.Errorf("got %v, %v; want the plaintext token migrated", tok, err)
+        }
+        if _, err := os.Stat(plaintextPath); !os.IsNotExist(err) {
+                t.Error("plaintext token file not deleted")
+        }
+
+        // nothing to migrate
+        if err := MigratePlaintextToken(plaintextPath, store); err != nil {
+                t.Error(err)
+        }
+}
+
+func TestMigratePlaintextTokenKeepsEncrypted(t *testing.T) {
+        dir := t.TempDir()
+        plaintextPath := filepath.Join(dir, "token.json")
+        if err := saveToken(plaintextPath, &oauth2.Token{RefreshToken: "stale"}); err != nil {
+                t.Fatal(err)
+        }
+        store := NewEncryptedFileTokenStore(filepath.Join(dir, "token.json.enc"), []byte("passphrase"))
+        if err := store.Save(&oauth2.Token{RefreshToken: "current"}); err != nil {
+                t.Fatal(err)
+        }
+
+        if err := MigratePlaintextToken(plaintextPath, store); err != nil {
+                t.Fatal(err)
+        }
+        tok, err := store.Load()
+        if err != nil || tok.RefreshToken != "current" {
+                t.Errorf("got %v, %v; want the encrypted token kept", tok, err)
+        }
+        if _, err := os.Stat(plaintextPath); err != nil {
+                t.Errorf("plaintext token file removed without being migrated: %v", err)
+        }
+
+        // nor overwritten when it can't be decrypted
+        wrongKeyStore := NewEncryptedFileTokenStore(store.Path, []byte("wrong"))
+        if err := MigratePlaintextToken(plaintextPath, wrongKeyStore); err != nil {
+                t.Fatal(err)
+        }
+        if tok, err := store.Load(); err != nil || tok.RefreshToken != "current" {
+                t.Errorf("got %v, %v; want the encrypted token kept", tok, err)
+        }
+}
@@ -0,0 +1,19 @@
+package oauth
+
+import (
+        "errors"
+)
+
+// Errors returned by GetClientContext and GetTokenSourceContext; test with errors.Is
+var (
+        // There's no cached token and the caller asked not to prompt the user
+        ErrNoToken = errors.New("oauth: no cached token")
+        // The authorization code or device code couldn't be exchanged for a token
+        ErrExchangeFailed = errors.New("oauth: unable to exchange authorization for token")
+        // The token lacks scopes the config requires
+        ErrScopeMismatch = errors.New("oauth: token lacks required scopes")
+        // The revocation endpoint rejected the token as already revoked or expired
+        ErrTokenInvalid = errors.New("oauth: token already revoked or expired")
+        // The device flow was asked for scopes Google doesn't allow it
+        ErrDeviceScope = errors.New("oauth: scope not allowed for the device flow")
+)
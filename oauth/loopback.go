@@ -0,0 +1,117 @@
+package oauth
+
+import (
+        "crypto/rand"
+        "encoding/base64"
+        "errors"
+        "fmt"
+        "net"
+        "net/http"
+        "time"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Shows the user the authorization URL.
+// Replace to open a browser or, in tests, to follow the URL against a fake authorization server.
+var OpenURL = func(authURL string) error {
+        fmt.Printf("Go to the following link in your browser to authorize access: \n%v\n", authURL)
+        return nil
+}
+
+// How long LoopbackFlow waits for the redirect, eg. if the user closes the consent screen
+var LoopbackTimeout = 5 * time.Minute
+
+// Replaces the deprecated copy-paste (out-of-band) flow:
+// starts a temporary listener on 127.0.0.1, redirects the consent screen back to it
+// and exchanges the code automatically.
+// Uses a random state per run to prevent CSRF and a PKCE verifier so an intercepted code is useless.
+func LoopbackFlow(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+
+        listener, err := net.Listen("tcp", "127.0.0.1:0") // any free port; Google accepts any loopback port for installed apps
+        if err != nil {
+                return nil, fmt.Errorf("unable to start loopback listener: %v", err)
+        }
+
+        state, err := randomString(32)
+        if err != nil {
+                return nil, err
+        }
+        verifier := oauth2.GenerateVerifier()
+
+        // copy so the caller's redirect URL (usually the oob urn from credentials.json) isn't modified
+        loopbackConfig := *config
+        loopbackConfig.RedirectURL = "http://" + listener.Addr().String() + "/"
+        // include_granted_scopes so re-authorizing for additional scopes keeps those already granted
+        authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier),
+                oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+
+        // buffered so the handler never blocks if the flow has already returned
+        codeCh := make(chan string, 1)
+        errCh := make(chan error, 1)
+
+        server := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+                if request.URL.Path != "/" {
+                        http.NotFound(writer, request) // eg. favicon.ico
+                        return
+                }
+                query := request.URL.Query()
+                if query.Get("state") != state {
+                        // don't abort the flow: this request didn't come from our consent screen
+                        http.Error(writer, "Invalid state", http.StatusBadRequest)
+                        return
+                }
+                if authErr := query.Get("error"); authErr != "" {
+                        http.Error(writer, "Authorization failed: "+authErr, http.StatusForbidden)
+                        select {
+                        case errCh <- errors.New("authorization failed: " + authErr):
+                        default:
+                        }
+                        return
+                }
+                code := query.Get("code")
+                if code == "" {
+                        http.Error(writer, "Missing authorization code", http.StatusBadRequest)
+                        return
+                }
+                fmt.Fprintln(writer, "Authorization complete; you may close this window.")
+                select {
+                case codeCh <- code:
+                default:
+                }
+        })}
+        go server.Serve(listener)
+        defer server.Close()
+
+        waitCtx, cancel := context.WithTimeout(ctx, LoopbackTimeout)
+        defer cancel()
+        if err := OpenURL(authURL); err != nil {
+                return nil, err
+        }
+
+        select {
+        case code := <-codeCh:
+                tok, err := loopbackConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+                if err != nil {
+                        return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+                }
+                return tok, nil
+        case err := <-errCh:
+                return nil, err
+        case <-waitCtx.Done():
+                if ctx.Err() != nil {
+                        return nil, ctx.Err()
+                }
+                return nil, fmt.Errorf("no authorization after %v: %v", LoopbackTimeout, waitCtx.Err())
+        }
+}
+
+// URL-safe random string for the state parameter
+func randomString(byteLen int) (string, error) {
+        byt := make([]byte, byteLen)
+        if _, err := rand.Read(byt); err != nil {
+                return "", err
+        }
+        return base64.RawURLEncoding.EncodeToString(byt), nil
+}
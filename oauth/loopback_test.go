@@ -0,0 +1,169 @@
+package oauth
+
+import (
+        "crypto/sha256"
+        "encoding/base64"
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "strings"
+        "testing"
+        "time"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Fake token endpoint which only exchanges the code for the PKCE verifier matching the challenge in the consent URL
+func newFakeTokenServer(t *testing.T, challenge *string) *httptest.Server {
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                r.ParseForm()
+                sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+                if r.Form.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != *challenge {
+                        http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                fmt.Fprint(w, `{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`)
+        }))
+        t.Cleanup(server.Close)
+        return server
+}
+
+func fakeConfig(tokenURL string) *oauth2.Config {
+        return &oauth2.Config{
+                ClientID: "client",
+                ClientSecret: "secret",
+                Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/auth", TokenURL: tokenURL, AuthStyle: oauth2.AuthStyleInParams},
+                Scopes: []string{"scope"},
+        }
+}
+
+// Replaces OpenURL with the user's browser: calls redirect with the consent URL's parameters, then restores it
+func fakeBrowser(t *testing.T, redirect func(authQuery url.Values, redirectURL string) error) {
+        openURL := OpenURL
+        t.Cleanup(func() { OpenURL = openURL })
+        OpenURL = func(authURL string) error {
+                parsed, err := url.Parse(authURL)
+                if err != nil {
+                        return err
+                }
+                return redirect(parsed.Query(), parsed.Query().Get("redirect_uri"))
+        }
+}
+
+// Follows the redirect to the loopback listener, returning its status
+func callback(redirectURL string, params url.Values) (int, error) {
+        resp, err := http.Get(redirectURL + "?" + params.Encode())
+        if err != nil {
+                return 0, err
+        }
+        resp.Body.Close()
+        return resp.StatusCode, nil
+}
+
+func TestLoopbackFlow(t *testing.T) {
+        var challenge string
+        server := newFakeTokenServer(t, &challenge)
+        fakeBrowser(t, func(authQuery url.Values, redirectURL string) error {
+                challenge = authQuery.Get("code_challenge")
+                if authQuery.Get("code_challenge_method") != "S256" || challenge == "" {
+                        return errors.New("no S256 PKCE challenge in the consent URL")
+                }
+                if !strings.HasPrefix(redirectURL, "http://127.0.0.1:") {
+                        return errors.New("redirect isn't to the loopback listener: " + redirectURL)
+                }
+                status, err := callback(redirectURL, url.Values{"state": {authQuery.Get("state")}, "code": {"good-code"}})
+                if err == nil && status != http.StatusOK {
+                        err = fmt.Errorf("callback returned %d", status)
+                }
+                return err
+        })
+
+        tok, err := LoopbackFlow(context.Background(), fakeConfig(server.URL))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+                t.Errorf("got token %+v", tok)
+        }
+}
+
+func TestLoopbackFlowWrongVerifier(t *testing.T) {
+        // a code intercepted from another flow is exchanged with this flow's verifier, which doesn't match
+        challenge := "another flow's challenge"
+        server := newFakeTokenServer(t, &challenge)
+        fakeBrowser(t, func(authQuery url.Values, redirectURL string) error {
+                _, err := callback(redirectURL, url.Values{"state": {authQuery.Get("state")}, "code": {"good-code"}})
+                return err
+        })
+
+        _, err := LoopbackFlow(context.Background(), fakeConfig(server.URL))
+        if !errors.Is(err, ErrExchangeFailed) {
+                t.Errorf("got %v, want ErrExchangeFailed", err)
+        }
+}
+
+func TestLoopbackFlowStateMismatch(t *testing.T) {
+        var challenge string
+        server := newFakeTokenServer(t, &challenge)
+        fakeBrowser(t, func(authQuery url.Values, redirectURL string) error {
+                challenge = authQuery.Get("code_challenge")
+                // a forged redirect is rejected without ending the flow
+                status, err := callback(redirectURL, url.Values{"state": {"forged"}, "code": {"good-code"}})
+                if err != nil {
+                        return err
+                }
+                if status != http.StatusBadRequest {
+                        return fmt.Errorf("forged callback returned %d, want 400", status)
+                }
+                _, err = callback(redirectURL, url.Values{"state": {authQuery.Get("state")}, "code": {"good-code"}})
+                return err
+        })
+
+        tok, err := LoopbackFlow(context.Background(), fakeConfig(server.URL))
+        if err != nil {
+                t.Fatal(err)
+        }
+        if tok.AccessToken != "access" {
+                t.Errorf("got token %+v", tok)
+        }
+}
+
+func TestLoopbackFlowDenied(t *testing.T) {
+        var challenge string
+        server := newFakeTokenServer(t, &challenge)
+        fakeBrowser(t, func(authQuery url.Values, redirectURL string) error {
+                status, err := callback(redirectURL, url.Values{"state": {authQuery.Get("state")}, "error": {"access_denied"}})
+                if err == nil && status != http.StatusForbidden {
+                        err = fmt.Errorf("error callback returned %d, want 403", status)
+                }
+                return err
+        })
+
+        _, err := LoopbackFlow(context.Background(), fakeConfig(server.URL))
+        if err == nil || !strings.Contains(err.Error(), "access_denied") {
+                t.Errorf("got %v, want access_denied", err)
+        }
+}
+
+func TestLoopbackFlowTimeout(t *testing.T) {
+        timeout := LoopbackTimeout
+        defer func() { LoopbackTimeout = timeout }()
+        LoopbackTimeout = 50 * time.Millisecond
+        // the user never completes the consent screen
+        fakeBrowser(t, func(authQuery url.Values, redirectURL string) error {
+                return nil
+        })
+
+        start := time.Now()
+        _, err := LoopbackFlow(context.Background(), fakeConfig("http://127.0.0.1:0/token"))
+        if err == nil {
+                t.Fatal("want a timeout error")
+        }
+        if elapsed := time.Since(start); elapsed > 5 * time.Second {
+                t.Errorf("returned after %s, want after LoopbackTimeout", elapsed)
+        }
+}
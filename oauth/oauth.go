@@ -3,44 +3,166 @@
 package oauth
 
 import (
-        "encoding/json"
+        "errors"
         "fmt"
+        "io"
+        "io/ioutil"
         "log"
         "net/http"
         "os"
+        "path/filepath"
 
         "golang.org/x/net/context"
         "golang.org/x/oauth2"
 )
 
+// Default token cache in the working directory
+const DefaultTokenFile = "token.json"
+
+// Obtains a new token when there's none in the store, eg. LoopbackFlow or DeviceFlow
+type Flow func(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error)
+
+// Flows selectable by name, eg. from a command line flag
+var flowMap = map[string]Flow{
+        "loopback": LoopbackFlow,
+        "device": DeviceFlow,
+}
+
+// Look up a flow by its command line name: loopback or device
+func FlowByName(name string) (Flow, error) {
+        if flow, ok := flowMap[name]; ok {
+                return flow, nil
+        }
+        return nil, fmt.Errorf("unknown authorization flow %q; use loopback or device", name)
+}
+
+// Optional GetClient settings
+type Option func(*options)
+
+type options struct {
+        store TokenStore
+        flow Flow
+}
+
+// Load and save the token via this store instead of token.json in the working directory
+func WithTokenStore(store TokenStore) Option {
+        return func(o *options) {
+                o.store = store
+        }
+}
+
+// Obtain new tokens via this flow instead of LoopbackFlow
+func WithFlow(flow Flow) Option {
+        return func(o *options) {
+                o.flow = flow
+        }
+}
+
+// Never prompt the user, eg. in a web server or scheduled job:
+// return ErrNoToken or ErrScopeMismatch instead
+func NonInteractive() Option {
+        return WithFlow(nil)
+}
+
+func newOptions(opts []Option) *options {
+        o := &options{
+                store: NewFileTokenStore(DefaultTokenFile),
+                flow: LoopbackFlow,
+        }
+        for _, opt := range opts {
+                opt(o)
+        }
+        return o
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
 // Function name must be uppercase to export from library and easily accessible from main code
-func GetClient(config *oauth2.Config) *http.Client {
-        tokenFile := "token.json"
-        tok, err := tokenFromFile(tokenFile)
+// Terminates the program on failure; use GetClientContext to handle errors.
+func GetClient(config *oauth2.Config, opts ...Option) *http.Client {
+        client, err := GetClientContext(context.Background(), config, opts...)
         if err != nil {
-                tok = getTokenFromWeb(config)
-                saveToken(tokenFile, tok)
+                log.Fatalf("Unable to get oauth client: %v", err)
         }
-        return config.Client(context.Background(), tok)
+        return client
 }
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-        authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-        fmt.Printf("Go to the following link in your browser then type the "+
-                "authorization code: \n%v\n", authURL)
+// Same as GetClient, but returns errors so callers can recover, retry or surface them, eg. in a web UI.
+// ctx bounds the authorization flow and is used for token refreshes for the life of the client.
+func GetClientContext(ctx context.Context, config *oauth2.Config, opts ...Option) (*http.Client, error) {
+        tokenSource, err := GetTokenSourceContext(ctx, config, opts...)
+        if err != nil {
+                return nil, err
+        }
+        return oauth2.NewClient(ctx, tokenSource), nil
+}
 
-        var authCode string
-        if _, err := fmt.Scan(&authCode); err != nil {
-                log.Fatalf("Unable to read authorization code %v", err)
+// Retrieve a token, saves the token, then returns a token source which saves refreshed tokens.
+// Use this to share one token source between several API clients.
+// Terminates the program on failure; use GetTokenSourceContext to handle errors.
+func GetTokenSource(config *oauth2.Config, opts ...Option) oauth2.TokenSource {
+        tokenSource, err := GetTokenSourceContext(context.Background(), config, opts...)
+        if err != nil {
+                log.Fatalf("Unable to get oauth token: %v", err)
         }
+        return tokenSource
+}
 
-        tok, err := config.Exchange(context.TODO(), authCode)
+// Same as GetTokenSource, but returns errors
+func GetTokenSourceContext(ctx context.Context, config *oauth2.Config, opts ...Option) (oauth2.TokenSource, error) {
+        o := newOptions(opts)
+        tok, err := o.store.Load()
         if err != nil {
-                log.Fatalf("Unable to retrieve token from web %v", err)
+                if o.flow == nil {
+                        if errors.Is(err, ErrNoToken) {
+                                return nil, err
+                        }
+                        return nil, fmt.Errorf("%w: %v", ErrNoToken, err)
+                }
+                if tok, err = getTokenFromWeb(ctx, config, o); err != nil {
+                        return nil, err
+                }
+        } else {
+                // a legacy token whose scopes can't be looked up is used as is, rather than costing the user their login
+                // for a network error; a scope it lacks shows up as a 403 from the API instead
+                scopesKnown := GrantedScopes(tok) != nil
+                if !scopesKnown {
+                        tok, scopesKnown = recordGrantedScopes(ctx, config, o.store, tok)
+                }
+                if missing := MissingScopes(tok, config.Scopes); scopesKnown && len(missing) > 0 {
+                        if o.flow == nil {
+                                return nil, fmt.Errorf("%w: %v", ErrScopeMismatch, missing)
+                        }
+                        // re-authorize up front rather than failing with a 403 part way through a run;
+                        // the flows request incremental authorization so previously granted scopes are kept
+                        fmt.Printf("Cached token lacks scopes %v; re-authorizing\n", missing)
+                        if tok, err = getTokenFromWeb(ctx, config, o); err != nil {
+                                return nil, err
+                        }
+                }
         }
-        return tok
+        return NewSavingTokenSource(config.TokenSource(ctx, tok), o.store, tok), nil
+}
+
+// Same as GetClient, but loads and saves the token via the given store
+// so callers can share one token source without guessing paths
+func GetClientWithStore(config *oauth2.Config, store TokenStore, opts ...Option) *http.Client {
+        return GetClient(config, append(opts, WithTokenStore(store))...)
+}
+
+// Request a token from the web, saves it, then returns the retrieved token.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, o *options) (*oauth2.Token, error) {
+        tok, err := o.flow(ctx, config)
+        if err != nil {
+                return nil, err
+        }
+        // the user may have unticked some scopes on the consent screen; if the response didn't say, they're looked up on the next load
+        if missing := MissingScopes(tok, config.Scopes); GrantedScopes(tok) != nil && len(missing) > 0 {
+                return nil, fmt.Errorf("%w: consent wasn't granted for %v", ErrScopeMismatch, missing)
+        }
+        if err := o.store.Save(tok); err != nil {
+                return nil, fmt.Errorf("unable to cache oauth token: %v", err)
+        }
+        return tok, nil
 }
 
 // Retrieves a token from a local file.
@@ -50,18 +172,37 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
                 return nil, err
         }
         defer f.Close()
-        tok := &oauth2.Token{}
-        err = json.NewDecoder(f).Decode(tok)
-        return tok, err
+        return decodeToken(f)
 }
 
 // Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
+func saveToken(path string, token *oauth2.Token) error {
         fmt.Printf("Saving credential file to: %s\n", path)
-        f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+        return writeFileAtomic(path, func(w io.Writer) error {
+                return encodeToken(w, token)
+        })
+}
+
+// Writes to a temp file in the same directory then renames it,
+// so a crash or concurrent refresh never leaves a truncated cache.
+// The file is only readable by the current user.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+        f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
         if err != nil {
-                log.Fatalf("Unable to cache oauth token: %v", err)
+                return err
         }
-        defer f.Close()
-        json.NewEncoder(f).Encode(token)
+        // remove the temp file if anything fails; harmless after the rename
+        defer os.Remove(f.Name())
+        if err := f.Chmod(0600); err != nil {
+                f.Close()
+                return err
+        }
+        if err := write(f); err != nil {
+                f.Close()
+                return err
+        }
+        if err := f.Close(); err != nil {
+                return err
+        }
+        return os.Rename(f.Name(), path)
 }
\ No newline at end of file
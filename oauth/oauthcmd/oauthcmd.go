@@ -0,0 +1,120 @@
+// Reusable auth login/status/revoke commands for mow.cli apps built on the oauth package
+
+package oauthcmd
+
+import (
+        "oauth" // from https://github.com/demoforwork/public/tree/master/oauth
+
+        "errors"
+        "fmt"
+        "os"
+        "strings"
+        "time"
+
+        "github.com/jawher/mow.cli"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// What the commands need from the app: the OAuth config, where the token is cached and how to obtain a new one
+type Auth struct {
+        Config *oauth2.Config
+        Store oauth.TokenStore
+        Flow oauth.Flow
+}
+
+// Called when a command runs, ie. after the app's options (profile, credentials etc.) are parsed
+type Setup func() (*Auth, error)
+
+// Mount auth login, auth status and auth revoke under cmd, eg. the app's top-level command:
+//     oauthcmd.Mount(app.Cmd, setup)
+func Mount(cmd *cli.Cmd, setup Setup) {
+        cmd.Command("auth", "Manage the cached OAuth token", func(authCmd *cli.Cmd) {
+                authCmd.Command("login", "Authorize and cache a new token, even if one is already cached", func(loginCmd *cli.Cmd) {
+                        loginCmd.Action = func() {
+                                run(setup, login)
+                        }
+                })
+                authCmd.Command("status", "Show the cached token's identity, granted scopes and expiry", func(statusCmd *cli.Cmd) {
+                        statusCmd.Action = func() {
+                                run(setup, status)
+                        }
+                })
+                authCmd.Command("revoke", "Revoke the cached token and delete it", func(revokeCmd *cli.Cmd) {
+                        revokeCmd.Action = func() {
+                                run(setup, revoke)
+                        }
+                })
+        })
+}
+
+func run(setup Setup, command func(ctx context.Context, auth *Auth) error) {
+        auth, err := setup()
+        if err == nil {
+                err = command(context.Background(), auth)
+        }
+        if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                cli.Exit(1)
+        }
+}
+
+func login(ctx context.Context, auth *Auth) error {
+        if _, err := oauth.Login(ctx, auth.Config, oauth.WithTokenStore(auth.Store), oauth.WithFlow(auth.Flow)); err != nil {
+                return err
+        }
+        fmt.Println("Logged in")
+        return status(ctx, auth)
+}
+
+func status(ctx context.Context, auth *Auth) error {
+        tok, err := auth.Store.Load()
+        if err != nil {
+                return fmt.Errorf("no cached token; run auth login: %v", err)
+        }
+        // refresh an expired access token so the token info endpoint accepts it; saves the refreshed token
+        tok, err = oauth.NewSavingTokenSource(auth.Config.TokenSource(ctx, tok), auth.Store, tok).Token()
+        if err != nil {
+                return fmt.Errorf("unable to refresh cached token; run auth login: %v", err)
+        }
+        info, err := oauth.GetTokenInfo(ctx, tok)
+        if err != nil {
+                return err
+        }
+
+        identity := info.Email
+        if identity == "" {
+                identity = "user id " + info.UserId + " (grant the email scope to see the address)"
+        }
+        fmt.Printf("Identity: %s\n", identity)
+        fmt.Printf("Granted scopes:\n  %s\n", strings.Join(info.Scopes, "\n  "))
+        // token info is authoritative for the granted scopes, so check against those rather than the cache
+        if missing := oauth.MissingScopes(oauth.WithScopes(tok, info.Scopes), auth.Config.Scopes); len(missing) > 0 {
+                fmt.Printf("Missing scopes (re-authorized on the next run):\n  %s\n", strings.Join(missing, "\n  "))
+        }
+        fmt.Printf("Access token expires: %s (in %s)\n", info.Expiry.Format(time.RFC3339), time.Until(info.Expiry).Round(time.Second))
+        if tok.RefreshToken == "" {
+                fmt.Println("No refresh token: you'll need to log in again when the access token expires")
+        }
+        return nil
+}
+
+func revoke(ctx context.Context, auth *Auth) error {
+        tok, err := auth.Store.Load()
+        if err != nil {
+                return fmt.Errorf("no cached token to revoke: %v", err)
+        }
+        message := "Token revoked and deleted"
+        if err := oauth.Revoke(ctx, tok); errors.Is(err, oauth.ErrTokenInvalid) {
+                // nothing left to revoke, and the cached token is useless
+                message = "Token was already revoked or expired; deleted it"
+        } else if err != nil {
+                return err
+        }
+        if err := auth.Store.Delete(); err != nil {
+                return fmt.Errorf("token revoked but unable to delete it from the cache: %v", err)
+        }
+        fmt.Println(message)
+        return nil
+}
@@ -0,0 +1,109 @@
+package oauthcmd
+
+import (
+        "oauth"
+
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "reflect"
+        "testing"
+
+        "golang.org/x/oauth2"
+)
+
+// Points oauth.RevokeURL at the handler until the test ends
+func fakeRevokeEndpoint(t *testing.T, handler http.HandlerFunc) {
+        server := httptest.NewServer(handler)
+        revokeURL := oauth.RevokeURL
+        t.Cleanup(func() {
+                oauth.RevokeURL = revokeURL
+                server.Close()
+        })
+        oauth.RevokeURL = server.URL
+}
+
+// Runs the command as the auth subcommand would, returning its exit status.
+// cli.Exit panics with the status for mow.cli to catch, so recover it here.
+func exitStatus(store oauth.TokenStore, command func(setup Setup)) (status int) {
+        stdout, stderr := os.Stdout, os.Stderr
+        devNull, _ := os.Open(os.DevNull)
+        os.Stdout, os.Stderr = devNull, devNull
+        defer func() {
+                os.Stdout, os.Stderr = stdout, stderr
+                devNull.Close()
+                if r := recover(); r != nil {
+                        value := reflect.ValueOf(r)
+                        if value.Kind() != reflect.Int {
+                                panic(r)
+                        }
+                        status = int(value.Int())
+                }
+        }()
+        command(func() (*Auth, error) {
+                return &Auth{Config: &oauth2.Config{}, Store: store}, nil
+        })
+        return 0
+}
+
+func revokeCommand(setup Setup) {
+        run(setup, revoke)
+}
+
+func TestRevokeCommand(t *testing.T) {
+        var revoked string
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                r.ParseForm()
+                revoked = r.PostForm.Get("token")
+        })
+
+        store := oauth.NewMemoryTokenStore(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+        if status := exitStatus(store, revokeCommand); status != 0 {
+                t.Errorf("exit status %d, want 0", status)
+        }
+        if revoked != "refresh" {
+                t.Errorf("revoked %q, want the cached refresh token", revoked)
+        }
+        if _, err := store.Load(); err == nil {
+                t.Error("token still cached after revoke")
+        }
+}
+
+func TestRevokeCommandAlreadyRevoked(t *testing.T) {
+        // eg. the user removed access in their Google account
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusBadRequest)
+                w.Write([]byte(`{"error": "invalid_token", "error_description": "Token expired or revoked"}`))
+        })
+
+        store := oauth.NewMemoryTokenStore(&oauth2.Token{RefreshToken: "refresh"})
+        if status := exitStatus(store, revokeCommand); status != 0 {
+                t.Errorf("exit status %d, want 0", status)
+        }
+        if _, err := store.Load(); err == nil {
+                t.Error("invalid token still cached after revoke")
+        }
+}
+
+func TestRevokeCommandFailureKeepsToken(t *testing.T) {
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                http.Error(w, "unavailable", http.StatusServiceUnavailable)
+        })
+
+        // so the user can retry
+        store := oauth.NewMemoryTokenStore(&oauth2.Token{RefreshToken: "refresh"})
+        if status := exitStatus(store, revokeCommand); status != 1 {
+                t.Errorf("exit status %d, want 1", status)
+        }
+        if _, err := store.Load(); err != nil {
+                t.Errorf("token deleted although not revoked: %v", err)
+        }
+}
+
+func TestRevokeCommandNoToken(t *testing.T) {
+        store := oauth.NewMemoryTokenStore(nil)
+        if status := exitStatus(store, revokeCommand); status != 1 {
+                t.Errorf("exit status %d, want 1", status)
+        }
+}
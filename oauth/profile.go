@@ -0,0 +1,135 @@
+package oauth
+
+import (
+        "encoding/json"
+        "fmt"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+)
+
+// Environment variables for selecting a profile and overriding where profiles live
+const (
+        ProfileEnv = "OAUTH_PROFILE"
+        ConfigDirEnv = "OAUTH_CONFIG_DIR"
+)
+
+// Files within each profile directory
+const (
+        ProfileCredentialFile = "credentials.json"
+        ProfileCredentialDir = "credentials" // for apps which take several service account keys
+        ProfileTokenFile = DefaultTokenFile
+        ProfileSettingsFile = "profile.json"
+)
+
+// A named set of credentials, eg. one per tenant, so they don't have to be swapped by hand.
+// Each profile is a directory under the config directory holding its own
+// credentials.json (client secret or service account key) or credentials directory (service account keys),
+// token.json (cached token) and optionally profile.json with scopes to request
+// as well as the app's: {"scopes": ["https://..."]}
+type Profile struct {
+        Name string `json:"-"`
+        Dir string `json:"-"`
+        Scopes []string `json:"scopes,omitempty"`
+}
+
+// OAUTH_CONFIG_DIR if set, otherwise oauth/profiles under the user's config directory, eg. ~/.config/oauth/profiles
+func ConfigDir() (string, error) {
+        if dir := os.Getenv(ConfigDirEnv); dir != "" {
+                return dir, nil
+        }
+        dir, err := os.UserConfigDir()
+        if err != nil {
+                return "", err
+        }
+        return filepath.Join(dir, "oauth", "profiles"), nil
+}
+
+// Loads the named profile; the profile directory must exist
+func LoadProfile(name string) (*Profile, error) {
+        configDir, err := ConfigDir()
+        if err != nil {
+                return nil, fmt.Errorf("unable to find profile config directory: %v", err)
+        }
+        if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+                return nil, fmt.Errorf("invalid profile name %q", name)
+        }
+
+        profile := &Profile{Name: name, Dir: filepath.Join(configDir, name)}
+        info, err := os.Stat(profile.Dir)
+        if err != nil || !info.IsDir() {
+                return nil, fmt.Errorf("profile %s not found: create directory %s with its %s", name, profile.Dir, ProfileCredentialFile)
+        }
+
+        byt, err := ioutil.ReadFile(profile.Path(ProfileSettingsFile))
+        if err == nil {
+                if err := json.Unmarshal(byt, profile); err != nil {
+                        return nil, fmt.Errorf("unable to parse %s for profile %s: %v", ProfileSettingsFile, name, err)
+                }
+        } else if !os.IsNotExist(err) {
+                return nil, err
+        }
+        return profile, nil
+}
+
+// Names of all profiles under the config directory
+func ListProfiles() ([]string, error) {
+        var nameArr []string
+
+        configDir, err := ConfigDir()
+        if err != nil {
+                return nil, err
+        }
+        entries, err := ioutil.ReadDir(configDir)
+        if os.IsNotExist(err) {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        for _, entry := range entries {
+                if entry.IsDir() {
+                        nameArr = append(nameArr, entry.Name())
+                }
+        }
+        return nameArr, nil
+}
+
+// Path of a file within the profile directory
+func (p *Profile) Path(name string) string {
+        return filepath.Join(p.Dir, name)
+}
+
+func (p *Profile) CredentialFile() string {
+        return p.Path(ProfileCredentialFile)
+}
+
+// The profile's credentials directory if it has one, otherwise its credentials.json
+func (p *Profile) CredentialsPath() string {
+        if info, err := os.Stat(p.Path(ProfileCredentialDir)); err == nil && info.IsDir() {
+                return p.Path(ProfileCredentialDir)
+        }
+        return p.CredentialFile()
+}
+
+// The scopes the app requires followed by the profile's, without duplicates
+func (p *Profile) MergeScopes(required []string) []string {
+        var scopeArr []string
+
+        seenMap := make(map[string]bool)
+        for _, scope := range append(append([]string{}, required...), p.Scopes...) {
+                if !seenMap[scope] {
+                        seenMap[scope] = true
+                        scopeArr = append(scopeArr, scope)
+                }
+        }
+        return scopeArr
+}
+
+func (p *Profile) TokenFile() string {
+        return p.Path(ProfileTokenFile)
+}
+
+func (p *Profile) TokenStore() TokenStore {
+        return NewFileTokenStore(p.TokenFile())
+}
@@ -0,0 +1,34 @@
+package oauth
+
+import (
+        "os"
+        "reflect"
+        "testing"
+)
+
+func TestCredentialsPath(t *testing.T) {
+        profile := &Profile{Name: "tenant", Dir: t.TempDir()}
+        if got := profile.CredentialsPath(); got != profile.Path(ProfileCredentialFile) {
+                t.Errorf("got %s, want credentials.json", got)
+        }
+        if err := os.Mkdir(profile.Path(ProfileCredentialDir), 0700); err != nil {
+                t.Fatal(err)
+        }
+        if got := profile.CredentialsPath(); got != profile.Path(ProfileCredentialDir) {
+                t.Errorf("got %s, want the credentials directory", got)
+        }
+}
+
+func TestMergeScopes(t *testing.T) {
+        profile := &Profile{Scopes: []string{"b", "c"}}
+        required := []string{"a", "b"}
+        if got, want := profile.MergeScopes(required), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+                t.Errorf("got %v, want %v", got, want)
+        }
+        if !reflect.DeepEqual(required, []string{"a", "b"}) {
+                t.Errorf("required scopes modified: %v", required)
+        }
+        if got := (&Profile{}).MergeScopes(required); !reflect.DeepEqual(got, required) {
+                t.Errorf("without profile scopes got %v, want %v", got, required)
+        }
+}
@@ -0,0 +1,221 @@
+package oauth
+
+import (
+        "bytes"
+        "encoding/json"
+        "io/ioutil"
+        "math/rand"
+        "net/http"
+        "strconv"
+        "sync"
+        "time"
+)
+
+// Defaults for a RetryTransport's zero fields
+const (
+        DefaultMaxAttempts = 5
+        DefaultBaseDelay = time.Second
+        DefaultMaxDelay = 32 * time.Second
+        DefaultMaxRetryAfter = 2 * time.Minute
+)
+
+// Retries transient Google API failures with exponential backoff and full jitter:
+// 429, 5xx, 403 rate limit errors and network errors. Honors Retry-After up to MaxRetryAfter;
+// a longer one, eg. a daily quota, returns the response rather than hold the caller.
+// POST isn't idempotent, eg. sending mail or appending rows, so is only retried when the request
+// wasn't processed: 429, 403 rate limits and 503 with Retry-After.
+// A retried DELETE which gets 404 succeeded on an earlier attempt, so returns 204 No Content.
+// Use it beneath the OAuth transport so every client shares it, and pass the same context
+// to FindCredentials so token refreshes do too:
+//     ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: oauth.NewRetryTransport(nil)})
+//     creds, err := oauth.FindCredentials(ctx, credOpts)
+//     client := oauth2.NewClient(ctx, creds.TokenSource)
+// Safe for concurrent use.
+type RetryTransport struct {
+        Base http.RoundTripper // http.DefaultTransport if nil
+        MaxAttempts int // including the first
+        BaseDelay time.Duration // before the first retry, doubling for each one after
+        MaxDelay time.Duration // cap on the backoff, though not on Retry-After
+        MaxRetryAfter time.Duration // longest Retry-After to wait
+
+        mu sync.Mutex
+        countMap map[string]uint64
+}
+
+// Returns a RetryTransport with the default attempts and delays
+func NewRetryTransport(base http.RoundTripper) *RetryTransport {
+        return &RetryTransport{Base: base, MaxAttempts: DefaultMaxAttempts, BaseDelay: DefaultBaseDelay, MaxDelay: DefaultMaxDelay, MaxRetryAfter: DefaultMaxRetryAfter}
+}
+
+// Retries so far by reason, eg. "429", "503", "userRateLimitExceeded" or "network"
+func (t *RetryTransport) Counts() map[string]uint64 {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        countMap := make(map[string]uint64, len(t.countMap))
+        for reason, count := range t.countMap {
+                countMap[reason] = count
+        }
+        return countMap
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+        base := t.Base
+        if base == nil {
+                base = http.DefaultTransport
+        }
+        maxAttempts := t.MaxAttempts
+        if maxAttempts < 1 {
+                maxAttempts = DefaultMaxAttempts
+        }
+
+        for attempt := 1; ; attempt++ {
+                attemptReq := req
+                if attempt > 1 {
+                        // the previous attempt consumed the body
+                        if req.Body != nil && req.Body != http.NoBody {
+                                body, err := req.GetBody()
+                                if err != nil {
+                                        return nil, err
+                                }
+                                attemptReq = req.Clone(req.Context())
+                                attemptReq.Body = body
+                        }
+                }
+
+                resp, err := base.RoundTrip(attemptReq)
+                if attempt > 1 && req.Method == http.MethodDelete && err == nil && resp.StatusCode == http.StatusNotFound {
+                        resp.Body.Close()
+                        return &http.Response{
+                                Status: "204 No Content",
+                                StatusCode: http.StatusNoContent,
+                                Proto: resp.Proto,
+                                ProtoMajor: resp.ProtoMajor,
+                                ProtoMinor: resp.ProtoMinor,
+                                Header: make(http.Header),
+                                Body: http.NoBody,
+                                Request: req,
+                        }, nil
+                }
+                reason := retryReason(req, resp, err)
+                // a body which can't be replayed can't be retried
+                replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+                if reason == "" || attempt >= maxAttempts || !replayable || req.Context().Err() != nil {
+                        return resp, err
+                }
+
+                delay := t.backoff(attempt)
+                if resp != nil {
+                        if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && retryAfter > delay {
+                                if retryAfter > t.maxRetryAfter() {
+                                        return resp, err
+                                }
+                                delay = retryAfter
+                        }
+                        resp.Body.Close()
+                }
+                t.count(reason)
+
+                timer := time.NewTimer(delay)
+                select {
+                case <-req.Context().Done():
+                        timer.Stop()
+                        return nil, req.Context().Err()
+                case <-timer.C:
+                }
+        }
+}
+
+// A random delay up to BaseDelay * 2^(attempt-1), capped at MaxDelay
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+        baseDelay, maxDelay := t.BaseDelay, t.MaxDelay
+        if baseDelay <= 0 {
+                baseDelay = DefaultBaseDelay
+        }
+        if maxDelay <= 0 {
+                maxDelay = DefaultMaxDelay
+        }
+        ceiling := maxDelay
+        if attempt <= 30 && baseDelay << uint(attempt - 1) < maxDelay {
+                ceiling = baseDelay << uint(attempt - 1)
+        }
+        return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (t *RetryTransport) maxRetryAfter() time.Duration {
+        if t.MaxRetryAfter <= 0 {
+                return DefaultMaxRetryAfter
+        }
+        return t.MaxRetryAfter
+}
+
+func (t *RetryTransport) count(reason string) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        if t.countMap == nil {
+                t.countMap = make(map[string]uint64)
+        }
+        t.countMap[reason]++
+}
+
+// Why the attempt should be retried, or "" if it shouldn't
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+        // the server may have acted on a POST which failed part way, so only retry those it rejected unprocessed
+        idempotent := req.Method != http.MethodPost
+        if err != nil {
+                if idempotent {
+                        return "network"
+                }
+                return ""
+        }
+        switch resp.StatusCode {
+        case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+                if idempotent {
+                        return strconv.Itoa(resp.StatusCode)
+                }
+        case http.StatusServiceUnavailable:
+                if idempotent || resp.Header.Get("Retry-After") != "" {
+                        return strconv.Itoa(resp.StatusCode)
+                }
+        case http.StatusTooManyRequests:
+                return strconv.Itoa(resp.StatusCode)
+        case http.StatusForbidden:
+                // 403 is mostly permissions, which retrying won't fix; only retry rate limits
+                if reason := errorReason(resp); reason == "userRateLimitExceeded" || reason == "rateLimitExceeded" {
+                        return reason
+                }
+        }
+        return ""
+}
+
+// The reason in a Google API error body; restores the body for the caller
+func errorReason(resp *http.Response) string {
+        var body struct {
+                Error struct {
+                        Errors []struct {
+                                Reason string `json:"reason"`
+                        } `json:"errors"`
+                } `json:"error"`
+        }
+
+        byt, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        resp.Body = ioutil.NopCloser(bytes.NewReader(byt))
+        if err != nil || json.Unmarshal(byt, &body) != nil || len(body.Error.Errors) == 0 {
+                return ""
+        }
+        return body.Error.Errors[0].Reason
+}
+
+// Retry-After in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+        if value == "" {
+                return 0, false
+        }
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+                return time.Duration(seconds) * time.Second, true
+        }
+        if date, err := http.ParseTime(value); err == nil {
+                return time.Until(date), true
+        }
+        return 0, false
+}
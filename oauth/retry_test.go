@@ -0,0 +1,238 @@
+package oauth
+
+import (
+        "context"
+        "io/ioutil"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+// Fake API which answers each request with the next response in turn, repeating the last
+type fakeResponse struct {
+        status int
+        header map[string]string
+        body string
+}
+
+func newFakeAPI(t *testing.T, responses ...fakeResponse) (*httptest.Server, *int32) {
+        var count int32
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                n := int(atomic.AddInt32(&count, 1))
+                if n > len(responses) {
+                        n = len(responses)
+                }
+                response := responses[n - 1]
+                for k, v := range response.header {
+                        w.Header().Set(k, v)
+                }
+                w.WriteHeader(response.status)
+                w.Write([]byte(response.body))
+        }))
+        t.Cleanup(server.Close)
+        return server, &count
+}
+
+func fastTransport() *RetryTransport {
+        return &RetryTransport{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+}
+
+const rateLimitBody = `{"error": {"errors": [{"reason": "userRateLimitExceeded"}]}}`
+
+func TestRetryThenSucceed(t *testing.T) {
+        server, count := newFakeAPI(t, fakeResponse{status: 503}, fakeResponse{status: 500}, fakeResponse{status: 200, body: "ok"})
+        transport := fastTransport()
+        resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        body, _ := ioutil.ReadAll(resp.Body)
+        if resp.StatusCode != 200 || string(body) != "ok" || *count != 3 {
+                t.Errorf("got %d %q after %d attempts, want 200 \"ok\" after 3", resp.StatusCode, body, *count)
+        }
+        if counts := transport.Counts(); counts["503"] != 1 || counts["500"] != 1 {
+                t.Errorf("counts = %v", counts)
+        }
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+        server, count := newFakeAPI(t, fakeResponse{status: 500})
+        resp, err := (&http.Client{Transport: fastTransport()}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != 500 || *count != 4 {
+                t.Errorf("got %d after %d attempts, want 500 after 4", resp.StatusCode, *count)
+        }
+}
+
+func TestRetryAfter(t *testing.T) {
+        server, count := newFakeAPI(t, fakeResponse{status: 429, header: map[string]string{"Retry-After": "1"}}, fakeResponse{status: 200})
+        start := time.Now()
+        resp, err := (&http.Client{Transport: fastTransport()}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != 200 || *count != 2 {
+                t.Errorf("got %d after %d attempts, want 200 after 2", resp.StatusCode, *count)
+        }
+        if elapsed := time.Since(start); elapsed < time.Second {
+                t.Errorf("retried after %s, want at least the 1s Retry-After", elapsed)
+        }
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+        // eg. a daily quota: the caller gets the 429 rather than wait an hour
+        server, count := newFakeAPI(t, fakeResponse{status: 429, header: map[string]string{"Retry-After": "3600"}}, fakeResponse{status: 200})
+        transport := fastTransport()
+        transport.MaxRetryAfter = time.Second
+        start := time.Now()
+        resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != 429 || *count != 1 {
+                t.Errorf("got %d after %d attempts, want 429 after 1", resp.StatusCode, *count)
+        }
+        if elapsed := time.Since(start); elapsed > 5 * time.Second {
+                t.Errorf("returned after %s, want at once", elapsed)
+        }
+}
+
+func TestForbidden(t *testing.T) {
+        // permission errors aren't retried, and the caller still sees the error body
+        server, count := newFakeAPI(t, fakeResponse{status: 403, body: `{"error": {"errors": [{"reason": "insufficientFilePermissions"}]}}`})
+        resp, err := (&http.Client{Transport: fastTransport()}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        body, _ := ioutil.ReadAll(resp.Body)
+        if resp.StatusCode != 403 || *count != 1 || !strings.Contains(string(body), "insufficientFilePermissions") {
+                t.Errorf("got %d %q after %d attempts, want 403 with its body after 1", resp.StatusCode, body, *count)
+        }
+
+        // rate limits are
+        server, count = newFakeAPI(t, fakeResponse{status: 403, body: rateLimitBody}, fakeResponse{status: 200})
+        transport := fastTransport()
+        resp, err = (&http.Client{Transport: transport}).Get(server.URL)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != 200 || *count != 2 || transport.Counts()["userRateLimitExceeded"] != 1 {
+                t.Errorf("got %d after %d attempts, counts %v; want 200 after 2", resp.StatusCode, *count, transport.Counts())
+        }
+}
+
+func TestPostRetries(t *testing.T) {
+        // a POST which may have been processed isn't retried
+        for _, status := range []int{500, 502, 503, 504} {
+                server, count := newFakeAPI(t, fakeResponse{status: status}, fakeResponse{status: 200})
+                resp, err := (&http.Client{Transport: fastTransport()}).Post(server.URL, "text/plain", strings.NewReader("mail"))
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if resp.StatusCode != status || *count != 1 {
+                        t.Errorf("POST %d: got %d after %d attempts, want no retry", status, resp.StatusCode, *count)
+                }
+        }
+
+        // one which wasn't is, with its body
+        for _, response := range []fakeResponse{
+                {status: 429},
+                {status: 403, body: rateLimitBody},
+                {status: 503, header: map[string]string{"Retry-After": "0"}},
+        } {
+                var bodyArr []string
+                server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                        body, _ := ioutil.ReadAll(r.Body)
+                        bodyArr = append(bodyArr, string(body))
+                        if len(bodyArr) == 1 {
+                                for k, v := range response.header {
+                                        w.Header().Set(k, v)
+                                }
+                                w.WriteHeader(response.status)
+                                w.Write([]byte(response.body))
+                        }
+                }))
+                resp, err := (&http.Client{Transport: fastTransport()}).Post(server.URL, "text/plain", strings.NewReader("mail"))
+                server.Close()
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if resp.StatusCode != 200 || len(bodyArr) != 2 || bodyArr[1] != "mail" {
+                        t.Errorf("POST %d: got %d with bodies %q, want a retry with the same body", response.status, resp.StatusCode, bodyArr)
+                }
+        }
+}
+
+func TestNonReplayableBody(t *testing.T) {
+        server, count := newFakeAPI(t, fakeResponse{status: 503}, fakeResponse{status: 200})
+        // a plain reader, so http.NewRequest can't set GetBody
+        request, err := http.NewRequest("PUT", server.URL, ioutil.NopCloser(strings.NewReader("update")))
+        if err != nil {
+                t.Fatal(err)
+        }
+        resp, err := (&http.Client{Transport: fastTransport()}).Do(request)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != 503 || *count != 1 {
+                t.Errorf("got %d after %d attempts, want 503 after 1", resp.StatusCode, *count)
+        }
+}
+
+func TestRetriedDeleteNotFound(t *testing.T) {
+        // the first attempt deleted it but the response was lost
+        server, _ := newFakeAPI(t, fakeResponse{status: 502}, fakeResponse{status: 404})
+        request, _ := http.NewRequest("DELETE", server.URL, nil)
+        resp, err := (&http.Client{Transport: fastTransport()}).Do(request)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != http.StatusNoContent {
+                t.Errorf("got %d, want 204", resp.StatusCode)
+        }
+
+        // but a first attempt's 404 is genuine
+        server, _ = newFakeAPI(t, fakeResponse{status: 404})
+        request, _ = http.NewRequest("DELETE", server.URL, nil)
+        resp, err = (&http.Client{Transport: fastTransport()}).Do(request)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if resp.StatusCode != http.StatusNotFound {
+                t.Errorf("got %d, want 404", resp.StatusCode)
+        }
+}
+
+func TestContextCancelled(t *testing.T) {
+        server, _ := newFakeAPI(t, fakeResponse{status: 503})
+        transport := &RetryTransport{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute}
+        ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+        defer cancel()
+        request, _ := http.NewRequest("GET", server.URL, nil)
+        start := time.Now()
+        _, err := (&http.Client{Transport: transport}).Do(request.WithContext(ctx))
+        if err == nil {
+                t.Fatal("want the context's error")
+        }
+        if elapsed := time.Since(start); elapsed > 5 * time.Second {
+                t.Errorf("returned after %s, want on cancellation", elapsed)
+        }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+        if delay, ok := parseRetryAfter("3"); !ok || delay != 3 * time.Second {
+                t.Errorf("seconds: got %s %v", delay, ok)
+        }
+        date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+        if delay, ok := parseRetryAfter(date); !ok || delay < 58 * time.Second || delay > time.Minute {
+                t.Errorf("date: got %s %v", delay, ok)
+        }
+        if _, ok := parseRetryAfter("soon"); ok {
+                t.Error("invalid value parsed")
+        }
+}
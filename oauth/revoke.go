@@ -0,0 +1,102 @@
+package oauth
+
+import (
+        "encoding/json"
+        "fmt"
+        "io/ioutil"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "time"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Google endpoints; variables so they can be pointed at a local stub
+var (
+        RevokeURL = "https://oauth2.googleapis.com/revoke"
+        TokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+)
+
+// What Google knows about an access token
+type TokenInfo struct {
+        Email string // only if the token has the email scope
+        UserId string
+        Scopes []string
+        Expiry time.Time
+}
+
+// Runs the flow even if there's a cached token, eg. to switch user, then saves the new token
+func Login(ctx context.Context, config *oauth2.Config, opts ...Option) (*oauth2.Token, error) {
+        o := newOptions(opts)
+        if o.flow == nil {
+                return nil, ErrNoToken
+        }
+        return getTokenFromWeb(ctx, config, o)
+}
+
+// Revokes the token at Google's revocation endpoint.
+// Revoking the refresh token revokes the whole grant, including its access tokens.
+// Returns ErrTokenInvalid if Google no longer honors the token, eg. the user revoked it elsewhere.
+func Revoke(ctx context.Context, token *oauth2.Token) error {
+        tokenVal := token.RefreshToken
+        if tokenVal == "" {
+                tokenVal = token.AccessToken
+        }
+        request, err := http.NewRequest("POST", RevokeURL, strings.NewReader(url.Values{"token": {tokenVal}}.Encode()))
+        if err != nil {
+                return err
+        }
+        request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+        if err != nil {
+                return fmt.Errorf("unable to revoke token: %v", err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                body, _ := ioutil.ReadAll(resp.Body)
+                var revokeErr struct {
+                        Error string `json:"error"`
+                }
+                if resp.StatusCode == http.StatusBadRequest && json.Unmarshal(body, &revokeErr) == nil && revokeErr.Error == "invalid_token" {
+                        return fmt.Errorf("%w: %s", ErrTokenInvalid, strings.TrimSpace(string(body)))
+                }
+                return fmt.Errorf("unable to revoke token: %s %s", resp.Status, strings.TrimSpace(string(body)))
+        }
+        return nil
+}
+
+// Looks up the identity, scopes and expiry of the token's access token
+func GetTokenInfo(ctx context.Context, token *oauth2.Token) (*TokenInfo, error) {
+        var resp struct {
+                Email string `json:"email"`
+                Sub string `json:"sub"`
+                Scope string `json:"scope"`
+                Exp string `json:"exp"` // unix seconds, as a string
+                ErrorDescription string `json:"error_description"`
+        }
+
+        request, err := http.NewRequest("GET", TokenInfoURL + "?" + url.Values{"access_token": {token.AccessToken}}.Encode(), nil)
+        if err != nil {
+                return nil, err
+        }
+        httpResp, err := http.DefaultClient.Do(request.WithContext(ctx))
+        if err != nil {
+                return nil, fmt.Errorf("unable to get token info: %v", err)
+        }
+        defer httpResp.Body.Close()
+        if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+                return nil, fmt.Errorf("unable to parse token info: %v", err)
+        }
+        if httpResp.StatusCode != http.StatusOK {
+                return nil, fmt.Errorf("unable to get token info: %s %s", httpResp.Status, resp.ErrorDescription)
+        }
+
+        info := &TokenInfo{Email: resp.Email, UserId: resp.Sub, Scopes: strings.Fields(resp.Scope)}
+        if exp, err := strconv.ParseInt(resp.Exp, 10, 64); err == nil {
+                info.Expiry = time.Unix(exp, 0)
+        }
+        return info, nil
+}
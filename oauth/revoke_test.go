@@ -0,0 +1,116 @@
+package oauth
+
+import (
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "testing"
+        "time"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Points RevokeURL at the handler until the test ends
+func fakeRevokeEndpoint(t *testing.T, handler http.HandlerFunc) {
+        server := httptest.NewServer(handler)
+        revokeURL := RevokeURL
+        t.Cleanup(func() {
+                RevokeURL = revokeURL
+                server.Close()
+        })
+        RevokeURL = server.URL
+}
+
+// Points TokenInfoURL at the handler until the test ends
+func fakeTokenInfoEndpoint(t *testing.T, handler http.HandlerFunc) {
+        server := httptest.NewServer(handler)
+        tokenInfoURL := TokenInfoURL
+        t.Cleanup(func() {
+                TokenInfoURL = tokenInfoURL
+                server.Close()
+        })
+        TokenInfoURL = server.URL
+}
+
+func TestRevoke(t *testing.T) {
+        var method, contentType, revoked string
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                r.ParseForm()
+                method, contentType, revoked = r.Method, r.Header.Get("Content-Type"), r.PostForm.Get("token")
+        })
+
+        // the refresh token revokes the whole grant
+        err := Revoke(context.Background(), &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if method != "POST" || contentType != "application/x-www-form-urlencoded" || revoked != "refresh" {
+                t.Errorf("got %s %s token=%s, want a form POST of the refresh token", method, contentType, revoked)
+        }
+
+        if err := Revoke(context.Background(), &oauth2.Token{AccessToken: "access"}); err != nil {
+                t.Fatal(err)
+        }
+        if revoked != "access" {
+                t.Errorf("revoked %s, want the access token when there's no refresh token", revoked)
+        }
+}
+
+func TestRevokeRejected(t *testing.T) {
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                http.Error(w, `{"error": "invalid_token"}`, http.StatusBadRequest)
+        })
+
+        err := Revoke(context.Background(), &oauth2.Token{RefreshToken: "refresh"})
+        if !errors.Is(err, ErrTokenInvalid) {
+                t.Fatalf("got %v, want ErrTokenInvalid", err)
+        }
+}
+
+func TestRevokeUnavailable(t *testing.T) {
+        fakeRevokeEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                http.Error(w, "unavailable", http.StatusServiceUnavailable)
+        })
+
+        // the token may still be good, so the caller mustn't treat it as revoked
+        err := Revoke(context.Background(), &oauth2.Token{RefreshToken: "refresh"})
+        if err == nil || errors.Is(err, ErrTokenInvalid) {
+                t.Fatalf("got %v, want a failure other than ErrTokenInvalid", err)
+        }
+}
+
+func TestGetTokenInfo(t *testing.T) {
+        exp := time.Now().Add(time.Hour).Truncate(time.Second)
+        var accessToken string
+        fakeTokenInfoEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                accessToken = r.URL.Query().Get("access_token")
+                fmt.Fprintf(w, `{"email": "admin@example.com", "sub": "1234", "scope": "scope1 scope2", "exp": "%d"}`, exp.Unix())
+        })
+
+        info, err := GetTokenInfo(context.Background(), &oauth2.Token{AccessToken: "access"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if accessToken != "access" {
+                t.Errorf("looked up %q, want the access token", accessToken)
+        }
+        want := &TokenInfo{Email: "admin@example.com", UserId: "1234", Scopes: []string{"scope1", "scope2"}, Expiry: exp}
+        if !reflect.DeepEqual(info, want) {
+                t.Errorf("got %+v, want %+v", info, want)
+        }
+}
+
+func TestGetTokenInfoInvalid(t *testing.T) {
+        fakeTokenInfoEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(http.StatusBadRequest)
+                fmt.Fprint(w, `{"error": "invalid_token", "error_description": "Invalid Value"}`)
+        })
+
+        _, err := GetTokenInfo(context.Background(), &oauth2.Token{AccessToken: "expired"})
+        if err == nil {
+                t.Fatal("want an error for an invalid token")
+        }
+}
@@ -0,0 +1,99 @@
+package oauth
+
+import (
+        "encoding/json"
+        "fmt"
+        "io"
+        "strings"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+// Cached form of the token: oauth2.Token plus the scopes granted with it,
+// since oauth2.Token only keeps the token response's scope field in memory.
+// Token files written before scopes were recorded still decode, with no scopes, and are looked up once.
+type cachedToken struct {
+        *oauth2.Token
+        Scopes []string `json:"scopes,omitempty"`
+}
+
+func encodeToken(w io.Writer, token *oauth2.Token) error {
+        return json.NewEncoder(w).Encode(&cachedToken{token, GrantedScopes(token)})
+}
+
+func decodeToken(r io.Reader) (*oauth2.Token, error) {
+        cached := &cachedToken{Token: &oauth2.Token{}}
+        if err := json.NewDecoder(r).Decode(cached); err != nil {
+                return nil, err
+        }
+        return WithScopes(cached.Token, cached.Scopes), nil
+}
+
+// Scopes granted with the token, as returned in the token response's scope field
+// or recorded in the token cache; nil if unknown, eg. for a token cached before scopes were recorded
+func GrantedScopes(token *oauth2.Token) []string {
+        if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+                return strings.Fields(scope)
+        }
+        return nil
+}
+
+// Scopes in required which the token wasn't granted.
+// If the granted scopes are unknown, every required scope is missing; see recordGrantedScopes for legacy token caches.
+func MissingScopes(token *oauth2.Token, required []string) []string {
+        var (
+                missing []string
+                grantedMap = make(map[string]struct{})
+        )
+
+        granted := GrantedScopes(token)
+        if granted == nil {
+                return append([]string(nil), required...)
+        }
+        for _, scope := range granted {
+                grantedMap[scope] = struct{}{}
+        }
+        for _, scope := range required {
+                if _, ok := grantedMap[scope]; !ok {
+                        missing = append(missing, scope)
+                }
+        }
+        return missing
+}
+
+// Looks up and caches the scopes of a token cached before they were recorded, so it isn't re-authorized needlessly.
+// Returns the token unchanged and false if the lookup fails, eg. offline or if the refresh token has been revoked:
+// the scopes are then unknown rather than missing, and looked up again on the next run.
+func recordGrantedScopes(ctx context.Context, config *oauth2.Config, store TokenStore, token *oauth2.Token) (*oauth2.Token, bool) {
+        // refresh an expired access token so the token info endpoint accepts it; Google's refresh response has the scopes
+        refreshed, err := config.TokenSource(ctx, token).Token()
+        if err != nil {
+                fmt.Printf("Unable to look up the cached token's scopes: %v\n", err)
+                return token, false
+        }
+        if GrantedScopes(refreshed) == nil {
+                info, err := GetTokenInfo(ctx, refreshed)
+                if err != nil {
+                        fmt.Printf("Unable to look up the cached token's scopes: %v\n", err)
+                        return token, false
+                }
+                if len(info.Scopes) == 0 {
+                        return token, false
+                }
+                refreshed = WithScopes(refreshed, info.Scopes)
+        }
+        if err := store.Save(refreshed); err != nil {
+                // looked up again on the next run
+                fmt.Printf("Unable to record the cached token's scopes: %v\n", err)
+        }
+        return refreshed, true
+}
+
+// Attach scopes to the token the same way the token endpoint does, eg. those token info reports
+func WithScopes(token *oauth2.Token, scopes []string) *oauth2.Token {
+        if len(scopes) == 0 {
+                return token
+        }
+        return token.WithExtra(map[string]interface{}{"scope": strings.Join(scopes, " ")})
+}
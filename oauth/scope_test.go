@@ -0,0 +1,102 @@
+package oauth
+
+import (
+        "errors"
+        "fmt"
+        "net/http"
+        "reflect"
+        "testing"
+        "time"
+
+        "golang.org/x/net/context"
+        "golang.org/x/oauth2"
+)
+
+func TestMissingScopes(t *testing.T) {
+        required := []string{"a", "b"}
+        granted := WithScopes(&oauth2.Token{AccessToken: "access"}, []string{"a", "c"})
+        if got := MissingScopes(granted, required); !reflect.DeepEqual(got, []string{"b"}) {
+                t.Errorf("got %v, want [b]", got)
+        }
+        // eg. a token cached before scopes were recorded
+        unknown := &oauth2.Token{AccessToken: "access"}
+        if got := MissingScopes(unknown, required); !reflect.DeepEqual(got, required) {
+                t.Errorf("unknown scopes: got %v, want every required scope", got)
+        }
+}
+
+func TestLegacyTokenScopesLookedUp(t *testing.T) {
+        var lookups int
+        fakeTokenInfoEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                lookups++
+                fmt.Fprint(w, `{"sub": "1234", "scope": "a b"}`)
+        })
+        store := NewMemoryTokenStore(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)})
+        config := &oauth2.Config{Scopes: []string{"a"}}
+
+        for run := 0; run < 2; run++ {
+                if _, err := GetTokenSourceContext(context.Background(), config, WithTokenStore(store), NonInteractive()); err != nil {
+                        t.Fatalf("run %d: %v", run + 1, err)
+                }
+        }
+        if lookups != 1 {
+                t.Errorf("looked up %d times, want once", lookups)
+        }
+        tok, _ := store.Load()
+        if got := GrantedScopes(tok); !reflect.DeepEqual(got, []string{"a", "b"}) {
+                t.Errorf("cached scopes %v, want [a b]", got)
+        }
+
+        // lacking a required scope
+        config.Scopes = []string{"a", "c"}
+        _, err := GetTokenSourceContext(context.Background(), config, WithTokenStore(store), NonInteractive())
+        if !errors.Is(err, ErrScopeMismatch) {
+                t.Errorf("got %v, want ErrScopeMismatch", err)
+        }
+}
+
+func TestLegacyTokenLacksScope(t *testing.T) {
+        fakeTokenInfoEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+                fmt.Fprint(w, `{"sub": "1234", "scope": "a"}`)
+        })
+        store := NewMemoryTokenStore(&oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)})
+
+        // the lookup succeeded, so the scope really is missing
+        _, err := GetTokenSourceContext(context.Background(), &oauth2.Config{Scopes: []string{"a", "b"}}, WithTokenStore(store), NonInteractive())
+        if !errors.Is(err, ErrScopeMismatch) {
+                t.Errorf("got %v, want ErrScopeMismatch for a token lacking a scope", err)
+        }
+}
+
+func TestLegacyTokenScopesUnknown(t *testing.T) {
+        for name, handler := range map[string]http.HandlerFunc{
+                "rejected": func(w http.ResponseWriter, r *http.Request) {
+                        http.Error(w, `{"error_description": "Invalid Value"}`, http.StatusBadRequest)
+                },
+                "unavailable": func(w http.ResponseWriter, r *http.Request) {
+                        http.Error(w, `{"error_description": "Backend Error"}`, http.StatusServiceUnavailable)
+                },
+                // eg. offline
+                "unreachable": func(w http.ResponseWriter, r *http.Request) {
+                        panic(http.ErrAbortHandler)
+                },
+        } {
+                t.Run(name, func(t *testing.T) {
+                        fakeTokenInfoEndpoint(t, handler)
+                        store := NewMemoryTokenStore(&oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)})
+
+                        // a failed lookup isn't a missing scope, so the cached token is still used
+                        source, err := GetTokenSourceContext(context.Background(), &oauth2.Config{Scopes: []string{"a"}}, WithTokenStore(store), NonInteractive())
+                        if err != nil {
+                                t.Fatalf("got %v, want the cached token when the scopes can't be looked up", err)
+                        }
+                        if tok, err := source.Token(); err != nil || tok.AccessToken != "access" {
+                                t.Errorf("got %v %v, want the cached token", tok, err)
+                        }
+                        // and looked up again next time
+                        if tok, _ := store.Load(); GrantedScopes(tok) != nil {
+                                t.Errorf("cached scopes %v, want none recorded", GrantedScopes(tok))
+                        }
+                })
+        }
+}
@@ -0,0 +1,111 @@
+package oauth
+
+import (
+        "bytes"
+        "fmt"
+        "os"
+        "strings"
+        "sync"
+
+        "golang.org/x/oauth2"
+)
+
+// TokenStore loads, saves and deletes the cached token,
+// so the tools and any wrappers can share one token source
+type TokenStore interface {
+        Load() (*oauth2.Token, error)
+        Save(token *oauth2.Token) error
+        Delete() error
+}
+
+// Stores the token as JSON in a local file, eg. token.json
+type FileTokenStore struct {
+        Path string
+}
+
+func NewFileTokenStore(path string) *FileTokenStore {
+        return &FileTokenStore{Path: path}
+}
+
+func (s *FileTokenStore) Load() (*oauth2.Token, error) {
+        return tokenFromFile(s.Path)
+}
+
+func (s *FileTokenStore) Save(token *oauth2.Token) error {
+        return saveToken(s.Path, token)
+}
+
+func (s *FileTokenStore) Delete() error {
+        err := os.Remove(s.Path)
+        if os.IsNotExist(err) {
+                return nil
+        }
+        return err
+}
+
+// Keeps the token for the life of the process only; useful for tests and
+// for wrappers which obtain the token some other way
+type MemoryTokenStore struct {
+        mu sync.Mutex
+        token *oauth2.Token
+}
+
+func NewMemoryTokenStore(token *oauth2.Token) *MemoryTokenStore {
+        return &MemoryTokenStore{token: token}
+}
+
+func (s *MemoryTokenStore) Load() (*oauth2.Token, error) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if s.token == nil {
+                return nil, fmt.Errorf("%w in memory store", ErrNoToken)
+        }
+        // return a copy so callers can't modify the stored token
+        tok := *s.token
+        return &tok, nil
+}
+
+func (s *MemoryTokenStore) Save(token *oauth2.Token) error {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        tok := *token
+        s.token = &tok
+        return nil
+}
+
+func (s *MemoryTokenStore) Delete() error {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        s.token = nil
+        return nil
+}
+
+// Reads the token as JSON from an environment variable, eg. for scheduled jobs
+// where the token is injected as a secret. Save and Delete only affect the current process.
+type EnvTokenStore struct {
+        Name string
+}
+
+func NewEnvTokenStore(name string) *EnvTokenStore {
+        return &EnvTokenStore{Name: name}
+}
+
+func (s *EnvTokenStore) Load() (*oauth2.Token, error) {
+        val := os.Getenv(s.Name)
+        if val == "" {
+                return nil, fmt.Errorf("%w: environment variable %s is not set", ErrNoToken, s.Name)
+        }
+        return decodeToken(strings.NewReader(val))
+}
+
+func (s *EnvTokenStore) Save(token *oauth2.Token) error {
+        var buf bytes.Buffer
+        if err := encodeToken(&buf, token); err != nil {
+                return err
+        }
+        return os.Setenv(s.Name, strings.TrimSpace(buf.String()))
+}
+
+func (s *EnvTokenStore) Delete() error {
+        return os.Unsetenv(s.Name)
+}
@@ -0,0 +1,45 @@
+package oauth
+
+import (
+        "log"
+        "sync"
+
+        "golang.org/x/oauth2"
+)
+
+// Wraps a token source and writes each new token back to the store,
+// so refreshed access tokens and rotated refresh tokens survive the process
+// rather than long-running scans and scheduled jobs relying on a stale cache
+type savingTokenSource struct {
+        mu sync.Mutex
+        src oauth2.TokenSource
+        store TokenStore
+        last *oauth2.Token
+}
+
+// Returns a token source which saves every token src returns that differs from current
+func NewSavingTokenSource(src oauth2.TokenSource, store TokenStore, current *oauth2.Token) oauth2.TokenSource {
+        return &savingTokenSource{src: src, store: store, last: current}
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+        tok, err := s.src.Token()
+        if err != nil {
+                return nil, err
+        }
+
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if s.last == nil || tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+                // keep the granted scopes if the refresh response didn't include them
+                if GrantedScopes(tok) == nil && s.last != nil {
+                        tok = WithScopes(tok, GrantedScopes(s.last))
+                }
+                // the API call can still go ahead with the new token, so don't fail it
+                if err := s.store.Save(tok); err != nil {
+                        log.Printf("Unable to cache refreshed oauth token: %v", err)
+                }
+                s.last = tok
+        }
+        return tok, nil
+}